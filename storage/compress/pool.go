@@ -0,0 +1,145 @@
+package compress
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"../logging"
+	"../queue"
+)
+
+// Perm права и владелец сжатых файлов. UID и GID -1 оставляют владельца процесса
+type Perm struct {
+	Mode os.FileMode
+	UID  int
+	GID  int
+}
+
+// Pool сжимает файлы в фоне: name => name.gz
+type Pool struct {
+	jobs     *queue.Queue
+	perm     Perm
+	done     func(queue.Job)
+	wg       sync.WaitGroup
+	running  int64
+	failures int64
+}
+
+// NewPool создает инстанс Pool и запускает workers воркеров с очередью jobs.
+// Сжатые файлы получают права и владельца perm.
+// done, если не nil, вызывается после сжатия с путем к сжатому файлу,
+// а если сжать не удалось или файл не попал в очередь - с путем к исходному
+func NewPool(workers int, jobs *queue.Queue, perm Perm, done func(queue.Job)) *Pool {
+	p := &Pool{
+		jobs: jobs,
+		perm: perm,
+		done: done,
+	}
+	jobs.OnDrop(p.skip)
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.worker()
+	}
+	return p
+}
+
+func (p *Pool) worker() {
+	defer p.wg.Done()
+	for job := range p.jobs.Items() {
+		atomic.AddInt64(&p.running, 1)
+		filename := job.Path
+		if err := gzipFile(filename, p.perm); err != nil {
+			atomic.AddInt64(&p.failures, 1)
+			logging.Error("Can't compress file %s: %s", filename, err)
+		} else {
+			logging.Info("File compressed %s => %s.gz", filename, filename)
+			job.Path = filename + ".gz"
+		}
+		if p.done != nil {
+			p.done(job)
+		}
+		atomic.AddInt64(&p.running, -1)
+	}
+}
+
+// Push ставит файл job.Path в очередь на сжатие
+func (p *Pool) Push(job queue.Job) {
+	p.jobs.Push(job)
+}
+
+// skip передает в done файл, выкинутый из очереди, без сжатия
+func (p *Pool) skip(job queue.Job) {
+	logging.Error("Compression queue is full or stopped, file %s left uncompressed", job.Path)
+	if p.done != nil {
+		p.done(job)
+	}
+}
+
+// Stop дожидается сжатия всех файлов из очереди и останавливает воркеры.
+// Можно вызывать несколько раз, в том числе одновременно
+func (p *Pool) Stop() {
+	p.jobs.Close()
+	p.wg.Wait()
+}
+
+// Backlog возвращает количество файлов в очереди и в работе
+func (p *Pool) Backlog() int64 {
+	return int64(p.jobs.Len()) + atomic.LoadInt64(&p.running)
+}
+
+// Dropped возвращает количество файлов, не попавших в очередь
+func (p *Pool) Dropped() int64 {
+	return p.jobs.Dropped()
+}
+
+// Failures возвращает количество неудачных сжатий
+func (p *Pool) Failures() int64 {
+	return atomic.LoadInt64(&p.failures)
+}
+
+// gzipFile сжимает filename в filename.gz через временный файл и удаляет исходный.
+// Существующий filename.gz не перезаписывается, исходный файл тогда остается как есть
+func gzipFile(filename string, perm Perm) error {
+	src, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpname := filename + ".gz.tmp"
+	dst, err := os.OpenFile(tmpname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm.Mode)
+	if err != nil {
+		return err
+	}
+
+	// права выставляются явно, при создании на них влияет umask
+	err = dst.Chmod(perm.Mode)
+	if err == nil && (perm.UID >= 0 || perm.GID >= 0) {
+		err = dst.Chown(perm.UID, perm.GID)
+	}
+	zw := gzip.NewWriter(dst)
+	if err == nil {
+		_, err = io.Copy(zw, src)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+
+	// в отличие от rename, link не заменяет уже существующий filename.gz
+	err = os.Link(tmpname, filename+".gz")
+	os.Remove(tmpname)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
@@ -0,0 +1,135 @@
+package compress
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+
+	"../queue"
+)
+
+var testPerm = Perm{Mode: 0644, UID: -1, GID: -1}
+
+func TestGzipFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "access.log.1")
+	if err := ioutil.WriteFile(name, []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipFile(name, testPerm); err != nil {
+		t.Fatalf("gzipFile: %s", err)
+	}
+	if _, err := os.Stat(name + ".gz"); err != nil {
+		t.Errorf("compressed file: %s", err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("source file is not removed")
+	}
+	if _, err := os.Stat(name + ".gz.tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file is not removed")
+	}
+}
+
+func TestGzipFileKeepsExisting(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "access.log.1")
+	if err := ioutil.WriteFile(name, []byte("new\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name+".gz", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipFile(name, testPerm); err == nil {
+		t.Fatalf("gzipFile overwrote existing %s.gz", name)
+	}
+	if data, _ := ioutil.ReadFile(name + ".gz"); string(data) != "old" {
+		t.Errorf("existing compressed file changed: %q", data)
+	}
+	if data, _ := ioutil.ReadFile(name); string(data) != "new\n" {
+		t.Errorf("source file changed: %q", data)
+	}
+	if _, err := os.Stat(name + ".gz.tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file is not removed")
+	}
+}
+
+func TestDoneOnFailure(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "access.log.1")
+	if err := ioutil.WriteFile(name, []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name+".gz", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	jobs := make(chan queue.Job, 1)
+	p := NewPool(1, queue.NewQueue(1, queue.Block), testPerm, func(job queue.Job) { jobs <- job })
+	p.Push(queue.Job{Path: name, Group: "app", Key: "web01/access.log"})
+	p.Stop()
+
+	job := <-jobs
+	if job.Path != name || job.Group != "app" || job.Key != "web01/access.log" {
+		t.Errorf("done called with %+v, want uncompressed file %s", job, name)
+	}
+}
+
+func TestDoneOnDrop(t *testing.T) {
+	tests := []struct {
+		policy  queue.Policy
+		skipped string
+	}{
+		{queue.RejectNew, "access.log.3"},
+		{queue.DropOldest, "access.log.2"},
+	}
+	for _, tt := range tests {
+		started := make(chan bool)
+		release := make(chan bool)
+		var mu sync.Mutex
+		done := []string{}
+		p := NewPool(1, queue.NewQueue(1, tt.policy), testPerm, func(job queue.Job) {
+			mu.Lock()
+			done = append(done, job.Path)
+			mu.Unlock()
+			if job.Path == "access.log.1" {
+				close(started)
+				<-release
+			}
+		})
+		// missing files fail to compress, done still gets them
+		p.Push(queue.Job{Path: "access.log.1"})
+		<-started
+		p.Push(queue.Job{Path: "access.log.2"})
+		p.Push(queue.Job{Path: "access.log.3"})
+
+		mu.Lock()
+		if len(done) != 2 || done[1] != tt.skipped {
+			t.Errorf("%s: done called with %q before release, want %s skipped", tt.policy, done, tt.skipped)
+		}
+		mu.Unlock()
+		close(release)
+		p.Stop()
+		if len(done) != 3 {
+			t.Errorf("%s: done called with %q, want 3 files", tt.policy, done)
+		}
+	}
+}
+
+func TestGzipFileMode(t *testing.T) {
+	old := syscall.Umask(0077)
+	defer syscall.Umask(old)
+
+	name := filepath.Join(t.TempDir(), "access.log.1")
+	if err := ioutil.WriteFile(name, []byte("a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipFile(name, Perm{Mode: 0640, UID: -1, GID: -1}); err != nil {
+		t.Fatalf("gzipFile: %s", err)
+	}
+	stat, err := os.Stat(name + ".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode().Perm() != 0640 {
+		t.Errorf("compressed file mode %o, want 640", stat.Mode().Perm())
+	}
+}
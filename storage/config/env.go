@@ -0,0 +1,96 @@
+package config
+
+import (
+	"encoding"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ParseEnv переопределяет поля конфига cfg значениями из переменных окружения.
+// Имя переменной: prefix, "_" и toml-имя поля в верхнем регистре, например LOGCARRIER_DESTDIR.
+// Для вложенных структур имена соединяются через "_". Списки строк задаются через запятую
+func ParseEnv(cfg interface{}, prefix string) error {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config must be pointer to struct, got %T", cfg)
+	}
+	return parseEnvStruct(v.Elem(), prefix)
+}
+
+func parseEnvStruct(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("toml"), ",")[0]
+		if name == "" || name == "-" || field.PkgPath != "" {
+			continue
+		}
+		envName := prefix + "_" + strings.ToUpper(name)
+
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			if _, ok := fv.Addr().Interface().(encoding.TextUnmarshaler); !ok {
+				if err := parseEnvStruct(fv, envName); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		value, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+		if err := setValue(fv, value); err != nil {
+			return fmt.Errorf("%s: %s", envName, err)
+		}
+	}
+	return nil
+}
+
+func setValue(v reflect.Value, value string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		// base 0: modes may be written in octal, e.g. 0755
+		u, err := strconv.ParseUint(value, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		items := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testFilter struct {
+	Match string `toml:"match"`
+}
+
+type testLogging struct {
+	Level string `toml:"level"`
+}
+
+type testConfig struct {
+	Listen  string        `toml:"listen"`
+	Mode    os.FileMode   `toml:"file_mode"`
+	Wait    time.Duration `toml:"wait_timeout"`
+	Conns   int           `toml:"max_connections"`
+	Audit   bool          `toml:"audit_log"`
+	List    []string      `toml:"listen_list"`
+	Logging testLogging   `toml:"logging"`
+	Filters []testFilter  `toml:"filter"`
+	Skipped string
+}
+
+func TestParseEnv(t *testing.T) {
+	t.Setenv("LT_LISTEN", "127.0.0.1:1466")
+	t.Setenv("LT_FILE_MODE", "0640")
+	t.Setenv("LT_WAIT_TIMEOUT", "30")
+	t.Setenv("LT_MAX_CONNECTIONS", "0x10")
+	t.Setenv("LT_AUDIT_LOG", "true")
+	t.Setenv("LT_LISTEN_LIST", " a:1, ,b:2 ")
+	t.Setenv("LT_LOGGING_LEVEL", "debug")
+
+	cfg := &testConfig{Listen: "0.0.0.0:1466", Skipped: "default"}
+	if err := ParseEnv(cfg, "LT"); err != nil {
+		t.Fatalf("ParseEnv: %s", err)
+	}
+	want := &testConfig{
+		Listen:  "127.0.0.1:1466",
+		Mode:    0640,
+		Wait:    30,
+		Conns:   16,
+		Audit:   true,
+		List:    []string{"a:1", "b:2"},
+		Logging: testLogging{Level: "debug"},
+		Skipped: "default",
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("ParseEnv = %+v, want %+v", cfg, want)
+	}
+}
+
+func TestParseEnvErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"LT_FILTER", "web01/*"},
+		{"LT_FILE_MODE", "rw-r--r--"},
+		{"LT_WAIT_TIMEOUT", "30s"},
+		{"LT_AUDIT_LOG", "maybe"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(tt.name, tt.value)
+			if err := ParseEnv(&testConfig{}, "LT"); err == nil {
+				t.Errorf("%s=%s accepted", tt.name, tt.value)
+			}
+		})
+	}
+}
+
+func TestParseEnvNotPointer(t *testing.T) {
+	if err := ParseEnv(testConfig{}, "LT"); err == nil {
+		t.Errorf("ParseEnv accepted struct value")
+	}
+}
+
+func TestParseEnvUnsupported(t *testing.T) {
+	t.Setenv("LT_FILTER", "web01/*")
+	err := ParseEnv(&testConfig{}, "LT")
+	if err == nil || !strings.Contains(err.Error(), "LT_FILTER: unsupported type []config.testFilter") {
+		t.Errorf("ParseEnv error %v, want unsupported type of LT_FILTER", err)
+	}
+}
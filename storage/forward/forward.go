@@ -0,0 +1,295 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"../logging"
+)
+
+type chunk struct {
+	args   []string
+	data   []byte
+	queued time.Time
+}
+
+// rejectedError отказ storage, который не исправится повтором
+type rejectedError struct {
+	answer string
+}
+
+func (e *rejectedError) Error() string {
+	return "storage rejected data: " + e.answer
+}
+
+// Mirror копия данных одного запроса для Push. Копия больше очереди Forwarder
+// не хранится, так что память на запрос ограничена
+type Mirror struct {
+	buf  bytes.Buffer
+	max  int
+	over bool
+}
+
+// Write копирует p, после превышения размера копия выкидывается
+func (m *Mirror) Write(p []byte) (int, error) {
+	if m.over {
+		return len(p), nil
+	}
+	if m.buf.Len()+len(p) > m.max {
+		m.over = true
+		m.buf = bytes.Buffer{}
+		return len(p), nil
+	}
+	return m.buf.Write(p)
+}
+
+// Forwarder пересылает сохраненные данные в другой storage по протоколу 2.
+// Данные копятся в очереди размером не более maxBytes, при переполнении выкидываются самые старые
+type Forwarder struct {
+	sync.Mutex
+	addr     string
+	key      string
+	timeout  time.Duration
+	maxBytes int
+	queue    []*chunk
+	bytes    int
+	wake     chan bool
+	quit     chan bool
+	stopped  sync.Once
+	done     chan bool
+	errors   int64
+	dropped  int64
+	rejected int64
+	skipped  int64
+}
+
+// NewForwarder создает инстанс Forwarder и запускает отправку
+func NewForwarder(addr string, key string, timeout time.Duration, maxBytes int) *Forwarder {
+	f := &Forwarder{
+		addr:     addr,
+		key:      key,
+		timeout:  timeout,
+		maxBytes: maxBytes,
+		wake:     make(chan bool, 1),
+		quit:     make(chan bool),
+		done:     make(chan bool),
+	}
+	go f.loop()
+	return f
+}
+
+// NewMirror создает копию для запроса, размером не более очереди
+func (f *Forwarder) NewMirror() *Mirror {
+	return &Mirror{max: f.maxBytes}
+}
+
+// Push ставит данные файла dname/fname группы group из m в очередь на отправку.
+// Поля fields передаются в заголовке так же, как пришли.
+// Данные, не поместившиеся в m, не пересылаются
+func (f *Forwarder) Push(group string, dname string, fname string, fields map[string]string, m *Mirror) {
+	if m.over {
+		atomic.AddInt64(&f.skipped, 1)
+		logging.Error("%s/%s request is larger than forward queue, not forwarded", dname, fname)
+		return
+	}
+	data := m.buf.Bytes()
+	if len(data) == 0 {
+		return
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	args := []string{group, dname, fname}
+	for _, name := range names {
+		args = append(args, name+"="+fields[name])
+	}
+	c := &chunk{
+		args:   args,
+		data:   data,
+		queued: time.Now(),
+	}
+
+	f.Lock()
+	f.queue = append(f.queue, c)
+	f.bytes += len(data)
+	for f.bytes > f.maxBytes && len(f.queue) > 1 {
+		f.bytes -= len(f.queue[0].data)
+		f.queue = f.queue[1:]
+		atomic.AddInt64(&f.dropped, 1)
+	}
+	f.Unlock()
+
+	select {
+	case f.wake <- true:
+	default:
+	}
+}
+
+func (f *Forwarder) head() *chunk {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.queue) == 0 {
+		return nil
+	}
+	return f.queue[0]
+}
+
+func (f *Forwarder) pop(c *chunk) {
+	f.Lock()
+	defer f.Unlock()
+	// head may be already dropped by Push
+	if len(f.queue) > 0 && f.queue[0] == c {
+		f.bytes -= len(c.data)
+		f.queue = f.queue[1:]
+	}
+}
+
+func (f *Forwarder) loop() {
+	defer close(f.done)
+	backoff := time.Second
+	for {
+		c := f.head()
+		if c == nil {
+			select {
+			case <-f.wake:
+				continue
+			case <-f.quit:
+				return
+			}
+		}
+
+		err := f.send(c)
+		var rejected *rejectedError
+		if errors.As(err, &rejected) {
+			// повтор получит тот же ответ и задержит всю очередь
+			atomic.AddInt64(&f.rejected, 1)
+			logging.Error("Forward to %s failed, %d bytes dropped: %s", f.addr, len(c.data), err)
+			f.pop(c)
+			continue
+		}
+		if err != nil {
+			atomic.AddInt64(&f.errors, 1)
+			logging.Error("Forward to %s failed, retry in %s: %s", f.addr, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-f.quit:
+				return
+			}
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+		f.pop(c)
+	}
+}
+
+// checkAnswer проверяет ответ storage. Ответы 4xx, кроме "400 Busy" при
+// перегрузке и нехватке места, повторять бесполезно
+func checkAnswer(answer string, what string) error {
+	answer = strings.TrimSpace(answer)
+	if strings.HasPrefix(answer, "2") {
+		return nil
+	}
+	if strings.HasPrefix(answer, "4") && answer != "400 Busy" {
+		return &rejectedError{answer}
+	}
+	return fmt.Errorf("%s: %s", what, answer)
+}
+
+func (f *Forwarder) send(c *chunk) error {
+	conn, err := net.DialTimeout("tcp", f.addr, f.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(f.timeout))
+
+	reader := bufio.NewReader(conn)
+	header := append([]string{"DATA", f.key}, c.args[:3]...)
+	header = append(header, strconv.Itoa(len(c.data)), "v2")
+	header = append(header, c.args[3:]...)
+	if _, err := fmt.Fprintf(conn, "%s\n", strings.Join(header, " ")); err != nil {
+		return err
+	}
+	answer, err := reader.ReadString('\n')
+	if err == io.EOF && answer == "" {
+		// storage закрывает соединение без ответа при неверном ключе
+		// и непригодном заголовке
+		return &rejectedError{"connection closed after header"}
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkAnswer(answer, "storage not ready"); err != nil {
+		return err
+	}
+
+	if _, err := conn.Write(c.data); err != nil {
+		return err
+	}
+	if answer, err := reader.ReadString('\n'); err != nil {
+		return err
+	} else if err := checkAnswer(answer, "storage error"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Stop останавливает отправку. Возвращает количество неотправленных байт.
+// Повторные вызовы безопасны
+func (f *Forwarder) Stop() int {
+	f.stopped.Do(func() { close(f.quit) })
+	<-f.done
+	f.Lock()
+	defer f.Unlock()
+	return f.bytes
+}
+
+// QueuedBytes возвращает количество байт в очереди
+func (f *Forwarder) QueuedBytes() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.bytes
+}
+
+// Lag возвращает время ожидания самых старых данных в очереди
+func (f *Forwarder) Lag() time.Duration {
+	if c := f.head(); c != nil {
+		return time.Since(c.queued)
+	}
+	return 0
+}
+
+// Errors возвращает количество неудачных попыток отправки
+func (f *Forwarder) Errors() int64 {
+	return atomic.LoadInt64(&f.errors)
+}
+
+// Dropped возвращает количество выкинутых из-за переполнения очереди запросов
+func (f *Forwarder) Dropped() int64 {
+	return atomic.LoadInt64(&f.dropped)
+}
+
+// Rejected возвращает количество запросов, выкинутых из-за отказа storage
+func (f *Forwarder) Rejected() int64 {
+	return atomic.LoadInt64(&f.rejected)
+}
+
+// Skipped возвращает количество запросов, не пересланных из-за размера
+func (f *Forwarder) Skipped() int64 {
+	return atomic.LoadInt64(&f.skipped)
+}
@@ -0,0 +1,153 @@
+package forward
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type received struct {
+	header string
+	data   string
+}
+
+// fakeStorage accepts connections on l and answers them with answer
+// called for every header. Data of accepted requests is sent to out
+func fakeStorage(l net.Listener, answer func(header string) string, out chan received) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		reader := bufio.NewReader(conn)
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		header = strings.TrimSpace(header)
+		reply := answer(header)
+		if reply == "" {
+			conn.Close()
+			continue
+		}
+		conn.Write([]byte(reply + "\n"))
+		if !strings.HasPrefix(reply, "200") {
+			conn.Close()
+			continue
+		}
+		n, _ := strconv.Atoi(strings.Fields(header)[5])
+		data := make([]byte, n)
+		if _, err := io.ReadFull(reader, data); err == nil {
+			conn.Write([]byte("200 OK\n"))
+			out <- received{header, string(data)}
+		}
+		conn.Close()
+	}
+}
+
+func listen(t *testing.T, answer func(header string) string) (string, chan received) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	out := make(chan received, 10)
+	go fakeStorage(l, answer, out)
+	return l.Addr().String(), out
+}
+
+func mirror(f *Forwarder, data string) *Mirror {
+	m := f.NewMirror()
+	m.Write([]byte(data))
+	return m
+}
+
+func wait(t *testing.T, out chan received) received {
+	select {
+	case r := <-out:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing forwarded")
+	}
+	return received{}
+}
+
+func TestForward(t *testing.T) {
+	addr, out := listen(t, func(string) string { return "200 READY protocol 2" })
+	f := NewForwarder(addr, "key", time.Second, 1024)
+	defer f.Stop()
+
+	f.Push("app", "web01", "access.log", map[string]string{"b": "2", "a": "1"}, mirror(f, "a\nb\n"))
+	r := wait(t, out)
+	if r.header != "DATA key app web01 access.log 4 v2 a=1 b=2" || r.data != "a\nb\n" {
+		t.Errorf("forwarded %+v", r)
+	}
+}
+
+func TestForwardRejected(t *testing.T) {
+	answers := map[string]string{
+		"bad.log":    "400 Missing field host",
+		"nokey.log":  "",
+		"access.log": "200 READY protocol 2",
+	}
+	addr, out := listen(t, func(header string) string {
+		return answers[strings.Fields(header)[4]]
+	})
+	f := NewForwarder(addr, "key", time.Second, 1024)
+	defer f.Stop()
+
+	f.Push("app", "web01", "bad.log", nil, mirror(f, "a\n"))
+	f.Push("app", "web01", "nokey.log", nil, mirror(f, "b\n"))
+	f.Push("app", "web01", "access.log", nil, mirror(f, "c\n"))
+	// rejected chunks are dropped at once, without retry backoff
+	if r := wait(t, out); r.data != "c\n" {
+		t.Errorf("forwarded %+v, want access.log", r)
+	}
+	if f.Rejected() != 2 || f.Errors() != 0 {
+		t.Errorf("%d rejected, %d errors, want 2 rejected", f.Rejected(), f.Errors())
+	}
+}
+
+func TestForwardBusyRetried(t *testing.T) {
+	busy := true
+	addr, out := listen(t, func(string) string {
+		if busy {
+			busy = false
+			return "400 Busy"
+		}
+		return "200 READY protocol 2"
+	})
+	f := NewForwarder(addr, "key", time.Second, 1024)
+	defer f.Stop()
+
+	f.Push("app", "web01", "access.log", nil, mirror(f, "a\n"))
+	if r := wait(t, out); r.data != "a\n" {
+		t.Errorf("forwarded %+v", r)
+	}
+	if f.Rejected() != 0 || f.Errors() != 1 {
+		t.Errorf("%d rejected, %d errors, want 1 error", f.Rejected(), f.Errors())
+	}
+}
+
+func TestMirrorLimit(t *testing.T) {
+	f := NewForwarder("127.0.0.1:0", "key", time.Second, 4)
+	defer f.Stop()
+
+	m := f.NewMirror()
+	m.Write([]byte("a\nb\n"))
+	if n, err := m.Write([]byte("c\n")); n != 2 || err != nil {
+		t.Errorf("Write over limit = %d, %v, want 2, nil", n, err)
+	}
+	if m.buf.Len() != 0 {
+		t.Errorf("mirror keeps %d bytes over limit", m.buf.Len())
+	}
+	f.Push("app", "web01", "access.log", nil, m)
+	if f.Skipped() != 1 || f.QueuedBytes() != 0 {
+		t.Errorf("%d skipped, %d bytes queued, want request skipped", f.Skipped(), f.QueuedBytes())
+	}
+}
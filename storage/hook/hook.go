@@ -0,0 +1,198 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"../logging"
+	"../queue"
+)
+
+// Config настройки действий после ротации
+type Config struct {
+	Command string        // команда, {path}, {name}, {dir}, {group} и {key} заменяются на путь, имя, директорию, группу и dir/name файла
+	URL     string        // адрес, на который POST-ом отправляется Payload
+	Retries int           // количество повторов при неудаче
+	Backoff time.Duration // пауза перед первым повтором, удваивается с каждым следующим
+	Timeout time.Duration // ограничение времени одного запуска команды и одного запроса
+}
+
+// Payload тело запроса на Config.URL
+type Payload struct {
+	Path  string    `json:"path"`
+	Size  int64     `json:"size"`
+	Mtime time.Time `json:"mtime"`
+	Key   string    `json:"key"`
+	Group string    `json:"group"`
+}
+
+// Hook выполняет действия после ротации в фоне
+type Hook struct {
+	config   Config
+	jobs     *queue.Queue
+	client   *http.Client
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	running  int64
+	failures int64
+}
+
+// NewHook создает инстанс Hook и запускает workers воркеров с очередью jobs
+func NewHook(config Config, workers int, jobs *queue.Queue) *Hook {
+	h := &Hook{
+		config: config,
+		jobs:   jobs,
+		client: &http.Client{Timeout: config.Timeout},
+	}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	jobs.OnDrop(func(job queue.Job) {
+		logging.Error("Post-rotate queue is full or stopped, hook for %s skipped", job.Path)
+	})
+	for i := 0; i < workers; i++ {
+		h.wg.Add(1)
+		go h.worker()
+	}
+	return h
+}
+
+func (h *Hook) worker() {
+	defer h.wg.Done()
+	for job := range h.jobs.Items() {
+		if h.ctx.Err() != nil {
+			// Stop gave up waiting, rest of the queue is skipped
+			atomic.AddInt64(&h.failures, 1)
+			logging.Error("Post-rotate hook for %s skipped: stopped", job.Path)
+			continue
+		}
+		atomic.AddInt64(&h.running, 1)
+		backoff := h.config.Backoff
+		for attempt := 0; ; attempt++ {
+			err := h.run(job)
+			if err == nil {
+				break
+			}
+			if attempt >= h.config.Retries || h.ctx.Err() != nil {
+				atomic.AddInt64(&h.failures, 1)
+				logging.Error("Post-rotate hook for %s failed: %s", job.Path, err)
+				break
+			}
+			logging.Warning("Post-rotate hook for %s failed, retry in %s: %s", job.Path, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-h.ctx.Done():
+			}
+			backoff *= 2
+		}
+		atomic.AddInt64(&h.running, -1)
+	}
+}
+
+func (h *Hook) run(job queue.Job) error {
+	stat, err := os.Stat(job.Path)
+	if err != nil {
+		return err
+	}
+
+	ctx := h.ctx
+	if h.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.config.Timeout)
+		defer cancel()
+	}
+
+	if h.config.Command != "" {
+		replacer := strings.NewReplacer(
+			"{path}", job.Path,
+			"{name}", filepath.Base(job.Path),
+			"{dir}", filepath.Dir(job.Path),
+			"{group}", job.Group,
+			"{key}", job.Key,
+		)
+		args := strings.Fields(h.config.Command)
+		if len(args) == 0 {
+			return fmt.Errorf("blank command")
+		}
+		for i := range args {
+			args[i] = replacer.Replace(args[i])
+		}
+		if out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %s", err, bytes.TrimSpace(out))
+		}
+	}
+
+	if h.config.URL != "" {
+		body, _ := json.Marshal(Payload{
+			Path:  job.Path,
+			Size:  stat.Size(),
+			Mtime: stat.ModTime(),
+			Key:   job.Key,
+			Group: job.Group,
+		})
+		req, err := http.NewRequest("POST", h.config.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := h.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("%s answered %s", h.config.URL, resp.Status)
+		}
+	}
+
+	return nil
+}
+
+// Push ставит выполнение действий для файла job.Path в очередь
+func (h *Hook) Push(job queue.Job) {
+	h.jobs.Push(job)
+}
+
+// Stop дожидается выполнения всех действий из очереди, но не дольше wait, и останавливает воркеры.
+// По истечении wait выполняющиеся команды и запросы прерываются, оставшиеся в очереди пропускаются.
+// Можно вызывать несколько раз, в том числе одновременно
+func (h *Hook) Stop(wait time.Duration) {
+	h.jobs.Close()
+	done := make(chan bool)
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(wait):
+		logging.Error("Post-rotate hooks are still running after %s, interrupting", wait)
+		h.cancel()
+		<-done
+	}
+	h.cancel()
+}
+
+// Backlog возвращает количество файлов в очереди и в работе
+func (h *Hook) Backlog() int64 {
+	return int64(h.jobs.Len()) + atomic.LoadInt64(&h.running)
+}
+
+// Dropped возвращает количество файлов, не попавших в очередь
+func (h *Hook) Dropped() int64 {
+	return h.jobs.Dropped()
+}
+
+// Failures возвращает количество файлов, для которых действия не удались после всех повторов
+func (h *Hook) Failures() int64 {
+	return atomic.LoadInt64(&h.failures)
+}
@@ -0,0 +1,88 @@
+package hook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"../queue"
+)
+
+func TestPayload(t *testing.T) {
+	payloads := make(chan Payload, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p Payload
+		json.NewDecoder(r.Body).Decode(&p)
+		payloads <- p
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "access.log.1")
+	if err := ioutil.WriteFile(path, []byte("a\nb\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHook(Config{URL: server.URL, Timeout: time.Second}, 1, queue.NewQueue(1, queue.Block))
+	h.Push(queue.Job{Path: path, Group: "app", Key: "web01/access.log"})
+	h.Stop(time.Second)
+
+	p := <-payloads
+	if p.Path != path || p.Size != 4 || p.Key != "web01/access.log" || p.Group != "app" || p.Mtime.IsZero() {
+		t.Errorf("payload %+v", p)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	path := filepath.Join(t.TempDir(), "access.log.1")
+	if err := ioutil.WriteFile(path, []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHook(Config{URL: server.URL, Timeout: 50 * time.Millisecond}, 1, queue.NewQueue(1, queue.Block))
+	h.Push(queue.Job{Path: path})
+	h.Stop(time.Second)
+	if h.Failures() != 1 {
+		t.Errorf("%d failures, want 1", h.Failures())
+	}
+}
+
+func TestStopWait(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log.1")
+	if err := ioutil.WriteFile(path, []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHook(Config{Command: "sleep 10", Retries: 3, Backoff: time.Second}, 1, queue.NewQueue(2, queue.Block))
+	h.Push(queue.Job{Path: path})
+	h.Push(queue.Job{Path: path})
+
+	started := time.Now()
+	h.Stop(100 * time.Millisecond)
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("Stop took %s, want about 100ms", elapsed)
+	}
+	if h.Failures() != 2 {
+		t.Errorf("%d failures, want 2", h.Failures())
+	}
+}
+
+func TestBlankCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log.1")
+	if err := ioutil.WriteFile(path, []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHook(Config{Command: " \t"}, 1, queue.NewQueue(1, queue.Block))
+	h.Push(queue.Job{Path: path})
+	h.Stop(time.Second)
+	if h.Failures() != 1 {
+		t.Errorf("%d failures, want 1", h.Failures())
+	}
+}
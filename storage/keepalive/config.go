@@ -0,0 +1,19 @@
+//go:build go1.23
+// +build go1.23
+
+package keepalive
+
+import (
+	"net"
+	"time"
+)
+
+// Set включает keepalive: первая проба после idle простоя, следующие через interval
+func Set(conn *net.TCPConn, idle, interval time.Duration) error {
+	return conn.SetKeepAliveConfig(net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     idle,
+		Interval: interval,
+		Count:    -1,
+	})
+}
@@ -0,0 +1,3 @@
+// Package keepalive включает TCP keepalive независимо от версии Go:
+// net.KeepAliveConfig появился только в Go 1.23
+package keepalive
@@ -0,0 +1,29 @@
+package keepalive
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSet(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := Set(conn.(*net.TCPConn), 30*time.Second, 10*time.Second); err != nil {
+		t.Errorf("Set: %s", err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !go1.23
+// +build !go1.23
+
+package keepalive
+
+import (
+	"net"
+	"time"
+)
+
+// Set включает keepalive с периодом idle. До Go 1.23 интервал между пробами
+// отдельно не задается, SetKeepAlivePeriod выставляет idle и для него
+func Set(conn *net.TCPConn, idle, interval time.Duration) error {
+	if err := conn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return conn.SetKeepAlivePeriod(idle)
+}
@@ -0,0 +1,56 @@
+package lines
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// Dedup схлопывает подряд идущие одинаковые строки в одну строку и строку "(repeated N times)".
+// Повторы считаются не дольше window от первой строки, строки длиннее maxLen не схлопываются
+type Dedup struct {
+	window  time.Duration
+	maxLen  int
+	last    []byte
+	since   time.Time
+	repeats int
+}
+
+// NewDedup создает инстанс Dedup
+func NewDedup(window time.Duration, maxLen int) *Dedup {
+	return &Dedup{
+		window: window,
+		maxLen: maxLen,
+	}
+}
+
+// Push принимает строку и возвращает строки, которые нужно записать
+func (d *Dedup) Push(line []byte, now time.Time) [][]byte {
+	if d.last != nil && bytes.Equal(line, d.last) && now.Sub(d.since) < d.window {
+		d.repeats++
+		return nil
+	}
+
+	out := [][]byte{}
+	if summary := d.Flush(); summary != nil {
+		out = append(out, summary)
+	}
+	out = append(out, line)
+
+	if len(line) <= d.maxLen {
+		d.last = append(d.last[:0], line...)
+		d.since = now
+	}
+	return out
+}
+
+// Flush возвращает строку с количеством повторов, если они были, и сбрасывает состояние
+func (d *Dedup) Flush() []byte {
+	repeats := d.repeats
+	d.last = nil
+	d.repeats = 0
+	if repeats == 0 {
+		return nil
+	}
+	return []byte(fmt.Sprintf("(repeated %d times)\n", repeats))
+}
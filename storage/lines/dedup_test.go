@@ -0,0 +1,65 @@
+package lines
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	type push struct {
+		line  string
+		after time.Duration
+		out   []string
+	}
+	tests := []struct {
+		name   string
+		maxLen int
+		pushes []push
+		flush  string
+	}{
+		{"distinct lines", 100, []push{
+			{"a\n", 0, []string{"a\n"}},
+			{"b\n", 0, []string{"b\n"}},
+		}, ""},
+		{"repeats collapsed", 100, []push{
+			{"a\n", 0, []string{"a\n"}},
+			{"a\n", time.Second, []string{}},
+			{"a\n", 2 * time.Second, []string{}},
+			{"b\n", 3 * time.Second, []string{"(repeated 2 times)\n", "b\n"}},
+		}, ""},
+		{"summary on flush", 100, []push{
+			{"a\n", 0, []string{"a\n"}},
+			{"a\n", time.Second, []string{}},
+		}, "(repeated 1 times)\n"},
+		{"window expired", 100, []push{
+			{"a\n", 0, []string{"a\n"}},
+			{"a\n", 5 * time.Second, []string{}},
+			{"a\n", 10 * time.Second, []string{"(repeated 1 times)\n", "a\n"}},
+			{"a\n", 11 * time.Second, []string{}},
+		}, "(repeated 1 times)\n"},
+		{"long lines not collapsed", 2, []push{
+			{"long\n", 0, []string{"long\n"}},
+			{"long\n", time.Second, []string{"long\n"}},
+		}, ""},
+	}
+	for _, tt := range tests {
+		d := NewDedup(10*time.Second, tt.maxLen)
+		for i, p := range tt.pushes {
+			out := []string{}
+			for _, line := range d.Push([]byte(p.line), start.Add(p.after)) {
+				out = append(out, string(line))
+			}
+			if !reflect.DeepEqual(out, p.out) {
+				t.Errorf("%s: push %d returned %q, want %q", tt.name, i, out, p.out)
+			}
+		}
+		if got := string(d.Flush()); got != tt.flush {
+			t.Errorf("%s: Flush returned %q, want %q", tt.name, got, tt.flush)
+		}
+		if got := d.Flush(); got != nil {
+			t.Errorf("%s: second Flush returned %q, want nil", tt.name, got)
+		}
+	}
+}
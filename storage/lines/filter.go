@@ -0,0 +1,48 @@
+package lines
+
+import (
+	"bytes"
+	"regexp"
+)
+
+// Filter отбрасывает строки, содержащие одну из подстрок или подходящие под одно из регулярных выражений
+type Filter struct {
+	substrings [][]byte
+	regexps    []*regexp.Regexp
+}
+
+// NewFilter создает инстанс Filter
+func NewFilter(substrings []string, regexps []string) (*Filter, error) {
+	f := &Filter{}
+	for _, s := range substrings {
+		f.substrings = append(f.substrings, []byte(s))
+	}
+	for _, r := range regexps {
+		re, err := regexp.Compile(r)
+		if err != nil {
+			return nil, err
+		}
+		f.regexps = append(f.regexps, re)
+	}
+	return f, nil
+}
+
+// Keep возвращает false, если строку line нужно отбросить
+func (f *Filter) Keep(line []byte) bool {
+	for _, s := range f.substrings {
+		if bytes.Contains(line, s) {
+			return false
+		}
+	}
+	for _, re := range f.regexps {
+		if re.Match(line) {
+			return false
+		}
+	}
+	return true
+}
+
+// Transform реализует Transformer
+func (f *Filter) Transform(line []byte) ([]byte, bool) {
+	return line, f.Keep(line)
+}
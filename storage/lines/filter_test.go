@@ -0,0 +1,34 @@
+package lines
+
+import "testing"
+
+func TestFilter(t *testing.T) {
+	f, err := NewFilter([]string{"DEBUG"}, []string{`^health`, `status=[45]\d\d`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		line string
+		keep bool
+	}{
+		{"INFO started\n", true},
+		{"DEBUG value\n", false},
+		{"x DEBUG\n", false},
+		{"healthcheck ok\n", false},
+		{"GET /health\n", true},
+		{"status=503\n", false},
+		{"status=200\n", true},
+	}
+	for _, tt := range tests {
+		line, keep := f.Transform([]byte(tt.line))
+		if keep != tt.keep || string(line) != tt.line {
+			t.Errorf("Transform(%q) = %q, %v, want keep %v", tt.line, line, keep, tt.keep)
+		}
+	}
+}
+
+func TestFilterBadRegexp(t *testing.T) {
+	if _, err := NewFilter(nil, []string{"("}); err == nil {
+		t.Errorf("NewFilter accepted invalid regexp")
+	}
+}
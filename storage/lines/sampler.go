@@ -0,0 +1,37 @@
+package lines
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+// Sampler оставляет одну строку из rate: каждую rate-ю или случайно с вероятностью 1/rate
+type Sampler struct {
+	rate   uint64
+	random bool
+	count  uint64
+}
+
+// NewSampler создает инстанс Sampler
+func NewSampler(rate int, random bool) *Sampler {
+	if rate < 1 {
+		rate = 1
+	}
+	return &Sampler{
+		rate:   uint64(rate),
+		random: random,
+	}
+}
+
+// Keep возвращает false, если очередную строку нужно отбросить
+func (s *Sampler) Keep() bool {
+	if s.random {
+		return rand.Int63n(int64(s.rate)) == 0
+	}
+	return (atomic.AddUint64(&s.count, 1)-1)%s.rate == 0
+}
+
+// Transform реализует Transformer
+func (s *Sampler) Transform(line []byte) ([]byte, bool) {
+	return line, s.Keep()
+}
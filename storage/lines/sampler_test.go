@@ -0,0 +1,42 @@
+package lines
+
+import "testing"
+
+func TestSamplerEvery(t *testing.T) {
+	s := NewSampler(3, false)
+	kept := ""
+	for i := 0; i < 9; i++ {
+		if _, keep := s.Transform([]byte("x\n")); keep {
+			kept += "1"
+		} else {
+			kept += "0"
+		}
+	}
+	if kept != "100100100" {
+		t.Errorf("kept %s, want every 3rd line starting with the first", kept)
+	}
+}
+
+func TestSamplerRandom(t *testing.T) {
+	s := NewSampler(4, true)
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		if s.Keep() {
+			kept++
+		}
+	}
+	if kept < 2000 || kept > 3000 {
+		t.Errorf("kept %d of 10000 lines, want about 2500", kept)
+	}
+}
+
+func TestSamplerRateOne(t *testing.T) {
+	for _, rate := range []int{1, 0, -1} {
+		s := NewSampler(rate, false)
+		for i := 0; i < 3; i++ {
+			if !s.Keep() {
+				t.Errorf("rate %d: line %d dropped", rate, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package lines
+
+import (
+	"strconv"
+	"time"
+)
+
+// Stamper добавляет в начало строки время приема
+type Stamper struct {
+	format string
+}
+
+// NewStamper создает инстанс Stamper. format: rfc3339, epoch_ms или layout пакета time
+func NewStamper(format string) *Stamper {
+	return &Stamper{
+		format: format,
+	}
+}
+
+// Stamp возвращает строку line с временем now и пробелом в начале
+func (s *Stamper) Stamp(line []byte, now time.Time) []byte {
+	var out []byte
+	switch s.format {
+	case "rfc3339":
+		out = now.AppendFormat(make([]byte, 0, len(line)+26), time.RFC3339)
+	case "epoch_ms":
+		out = strconv.AppendInt(make([]byte, 0, len(line)+14), now.UnixNano()/int64(time.Millisecond), 10)
+	default:
+		out = now.AppendFormat(make([]byte, 0, len(line)+len(s.format)+1), s.format)
+	}
+	out = append(out, ' ')
+	return append(out, line...)
+}
+
+// Transform реализует Transformer, строка получает текущее время
+func (s *Stamper) Transform(line []byte) ([]byte, bool) {
+	return s.Stamp(line, time.Now()), true
+}
@@ -0,0 +1,30 @@
+package lines
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStamp(t *testing.T) {
+	now := time.Date(2026, 3, 4, 5, 6, 7, 890000000, time.FixedZone("", 3*3600))
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"rfc3339", "2026-03-04T05:06:07+03:00 a\n"},
+		{"epoch_ms", "1772589967890 a\n"},
+		{"2006-01-02 15:04:05.000", "2026-03-04 05:06:07.890 a\n"},
+	}
+	for _, tt := range tests {
+		if got := string(NewStamper(tt.format).Stamp([]byte("a\n"), now)); got != tt.want {
+			t.Errorf("Stamp with %s = %q, want %q", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestStampTransform(t *testing.T) {
+	line, keep := NewStamper("epoch_ms").Transform([]byte("a\n"))
+	if !keep || len(line) != len("1772589967890 a\n") {
+		t.Errorf("Transform = %q, %v, want stamped line", line, keep)
+	}
+}
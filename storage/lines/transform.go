@@ -0,0 +1,20 @@
+package lines
+
+// Transformer преобразует строку перед записью. false означает, что строку нужно отбросить
+type Transformer interface {
+	Transform(line []byte) ([]byte, bool)
+}
+
+// Chain применяет Transformer'ы по порядку, пока строка не отброшена
+type Chain []Transformer
+
+// Transform реализует Transformer
+func (c Chain) Transform(line []byte) ([]byte, bool) {
+	for _, t := range c {
+		var keep bool
+		if line, keep = t.Transform(line); !keep {
+			return nil, false
+		}
+	}
+	return line, true
+}
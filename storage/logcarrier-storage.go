@@ -3,14 +3,19 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"path"
+	"os/user"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,38 +23,381 @@ import (
 	"syscall"
 	"time"
 
+	"./compress"
 	"./config"
+	"./forward"
+	"./hook"
+	"./keepalive"
+	"./lines"
 	"./logging"
+	"./queue"
+	"./ratelimit"
+	"./streams"
 )
 
 import _ "net/http/pprof"
 
 var locksCount int32 = 0
+var connsCount int32 = 0
+var connsPeak int32 = 0
+var throttledBytes = expvar.NewInt("throttled_bytes")
+var rejectedHeaders = expvar.NewInt("rejected_headers")
+var fsyncCount = expvar.NewInt("fsync_count")
+var fsyncTime = expvar.NewInt("fsync_usec_total")
+var fsyncMaxTime = expvar.NewInt("fsync_usec_max")
+var filteredLines = expvar.NewInt("filtered_lines")
+var sampledLines = expvar.NewInt("sampled_out_lines")
+var dedupLines = expvar.NewInt("deduplicated_lines")
+var openRetries = expvar.NewInt("open_retries")
+var openFailures = expvar.NewInt("open_failures")
+var fullRejected = expvar.NewInt("disk_full_rejected")
+
+// fullUntil time in UnixNano until DATA requests are rejected after ENOSPC
+var fullUntil int64
+
+// writerPool reuses file write buffers between requests, New is set in main from config
+var writerPool = &sync.Pool{}
+
+// active lists running DATA requests on debug endpoint
+var active = streams.NewRegistry()
+
+// compressor compresses rotated files, nil when rotate_compress is off
+var compressor *compress.Pool
+
+// lineFilters compiled filter rules from config, in config order
+var lineFilters []lineFilter
+
+type lineFilter struct {
+	match  string
+	filter *lines.Filter
+}
+
+// sampleConfigs sampling rules from config, in config order
+var sampleConfigs []SampleConfig
+
+// dedupConfigs deduplication rules from config, in config order
+var dedupConfigs []DedupConfig
+
+// stampConfigs timestamping rules from config, in config order
+var stampConfigs []StampConfig
+
+// postRotate runs post-rotate actions, nil when they are not configured
+var postRotate *hook.Hook
+
+// forwarder mirrors stored data to forward_to, nil when it is not configured
+var forwarder *forward.Forwarder
+
+const nameMaxLen = 255
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+const fileflag int = os.O_CREATE | os.O_APPEND | os.O_RDWR
+
+// fileUID, fileGID owner of created files, -1 keeps owner of the process
+var fileUID, fileGID = -1, -1
+
+// nameChars characters allowed in names from header, ":" is left out as it opens
+// alternate data streams on NTFS
+var nameChars = regexp.MustCompile(`^[A-Za-z0-9_.@+=,-]+$`)
+var protocolToken = regexp.MustCompile(`^v[0-9]+$`)
+
+var pathTemplateToken = regexp.MustCompile(`\{([a-z]*)(?:\.([A-Za-z0-9_-]+))?\}`)
+var pathTemplateBraces = regexp.MustCompile(`\{[^{}]*\}`)
+var pathTemplateTokens = map[string]bool{
+	"yyyy":  true,
+	"mm":    true,
+	"dd":    true,
+	"hh":    true,
+	"group": true,
+	"dir":   true,
+	"name":  true,
+	"field": true,
+}
+
+var fieldToken = regexp.MustCompile(`^([A-Za-z0-9_-]+)=(.+)$`)
+
+// rotateNamers builds name of rotated file, used when ROTATE has no explicit new name
+var rotateNamers = map[string]func(dpath string, fname string, t time.Time) string{
+	"timestamp": func(dpath string, fname string, t time.Time) string {
+		return fmt.Sprintf("%s-%d%02d%02d%02d%02d%02d", fname, t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second())
+	},
+	"iso8601": func(dpath string, fname string, t time.Time) string {
+		// basic format without ":", which is not allowed in file names on windows
+		return fmt.Sprintf("%s-%s", fname, t.UTC().Format("20060102T150405Z"))
+	},
+	"index": func(dpath string, fname string, t time.Time) string {
+		i := 1
+		// rotated files may be already compressed
+		for PathExists(filepath.Join(dpath, fmt.Sprintf("%s.%d", fname, i))) || PathExists(filepath.Join(dpath, fmt.Sprintf("%s.%d.gz", fname, i))) {
+			i++
+		}
+		return fmt.Sprintf("%s.%d", fname, i)
+	},
+}
+
+func init() {
+	expvar.Publish("connections", expvar.Func(func() interface{} {
+		return map[string]int32{
+			"current": atomic.LoadInt32(&connsCount),
+			"peak":    atomic.LoadInt32(&connsPeak),
+		}
+	}))
+	expvar.Publish("disk_full", expvar.Func(func() interface{} {
+		return diskFull()
+	}))
+}
+
+// stateIdle time after which state of unused file is dropped by Locks.Evict
+const stateIdle = 10 * time.Minute
 
 type Locks struct {
 	sync.RWMutex
-	fmap map[string]*sync.RWMutex
+	fmap    map[string]*sync.RWMutex
+	limits  map[string]*ratelimit.Bucket
+	samples map[string]*lines.Sampler
+	writes  map[string]int
+	users   map[string]int
+	used    map[string]time.Time
+}
+
+// Sampler returns sampler of file fpath of stream dname/fname, nil if stream is not sampled.
+// Sampler lives as long as the file lock, so "every" mode counts lines across requests
+func (l *Locks) Sampler(fpath string, dname string, fname string) *lines.Sampler {
+	for _, sc := range sampleConfigs {
+		if ok, _ := filepath.Match(sc.Match, dname+"/"+fname); !ok {
+			continue
+		}
+		l.Lock()
+		defer l.Unlock()
+		if _, ok := l.samples[fpath]; !ok {
+			l.samples[fpath] = lines.NewSampler(sc.Rate, sc.Mode == "random")
+		}
+		return l.samples[fpath]
+	}
+	return nil
+}
+
+// SyncDue counts successful write to fpath and reports whether it is time to fsync the file
+func (l *Locks) SyncDue(fpath string, every int) bool {
+	l.Lock()
+	defer l.Unlock()
+	l.writes[fpath]++
+	if l.writes[fpath] < every {
+		return false
+	}
+	l.writes[fpath] = 0
+	return true
+}
+
+// newLocks returns empty Locks
+func newLocks() *Locks {
+	return &Locks{
+		fmap:    make(map[string]*sync.RWMutex),
+		limits:  make(map[string]*ratelimit.Bucket),
+		writes:  make(map[string]int),
+		samples: make(map[string]*lines.Sampler),
+		users:   make(map[string]int),
+		used:    make(map[string]time.Time),
+	}
+}
+
+// FileLock returns lock guarding writes and rotation of file fpath.
+// Every FileLock has to be paired with Release once the lock is not needed
+func (l *Locks) FileLock(fpath string) *sync.RWMutex {
+	l.Lock()
+	defer l.Unlock()
+	if _, ok := l.fmap[fpath]; !ok {
+		l.fmap[fpath] = new(sync.RWMutex)
+	}
+	l.users[fpath]++
+	return l.fmap[fpath]
+}
+
+// Release marks that file lock of fpath taken by FileLock is not used any more
+func (l *Locks) Release(fpath string) {
+	l.Lock()
+	defer l.Unlock()
+	l.users[fpath]--
+	if l.users[fpath] <= 0 {
+		delete(l.users, fpath)
+	}
+	l.used[fpath] = time.Now()
+}
+
+// Evict drops lock, rate limit, sampler and sync counter of files nobody used for idle.
+// Files with dates in path_template get new names every period, without eviction
+// their state would pile up forever. A file used again later starts with fresh state
+func (l *Locks) Evict(idle time.Duration) int {
+	l.Lock()
+	defer l.Unlock()
+	evicted := 0
+	for fpath, used := range l.used {
+		if l.users[fpath] > 0 || time.Since(used) < idle {
+			continue
+		}
+		delete(l.fmap, fpath)
+		delete(l.limits, fpath)
+		delete(l.samples, fpath)
+		delete(l.writes, fpath)
+		delete(l.used, fpath)
+		evicted++
+	}
+	return evicted
+}
+
+// evictLoop calls Evict every minute until stopping is closed
+func (l *Locks) evictLoop(stopping chan bool) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if n := l.Evict(stateIdle); n > 0 {
+				logging.Debug("Dropped state of %d idle files", n)
+			}
+		case <-stopping:
+			return
+		}
+	}
+}
+
+// FilterConfig drops protocol 1 lines of streams matching glob Match ("dirname/filename")
+type FilterConfig struct {
+	Match      string   `toml:"match"`
+	DropSubstr []string `toml:"drop_substr"`
+	DropRegexp []string `toml:"drop_regexp"`
+}
+
+// SampleConfig keeps one of Rate protocol 1 lines of streams matching glob Match ("dirname/filename").
+// Mode "every" keeps every Rate-th line, "random" keeps lines with probability 1/Rate
+type SampleConfig struct {
+	Match string `toml:"match"`
+	Rate  int    `toml:"rate"`
+	Mode  string `toml:"mode"`
+}
+
+// DedupConfig collapses repeated consecutive protocol 1 lines of streams matching glob Match
+// ("dirname/filename") for at most Window seconds. Lines longer than MaxLine are not collapsed
+type DedupConfig struct {
+	Match   string        `toml:"match"`
+	Window  time.Duration `toml:"window"`
+	MaxLine int           `toml:"max_line"`
+}
+
+// StampConfig prepends receive time to protocol 1 lines of streams matching glob Match
+// ("dirname/filename"). Format is rfc3339, epoch_ms or a Go time layout
+type StampConfig struct {
+	Match  string `toml:"match"`
+	Format string `toml:"format"`
 }
 
 type Config struct {
-	Listen      string        `toml:"listen"`
-	ListenDebug string        `toml:"listen_debug"`
-	WaitTimeout time.Duration `toml:"wait_timeout"`
-	Key         string        `toml:"key"`
-	DestDir     string        `toml:"destdir"`
-	DestDirMode os.FileMode   `toml:"destdir_mode"`
-	LogFile     string        `toml:"logfile"`
+	Listen      string         `toml:"listen"`
+	ListenList  []string       `toml:"listen_list"`
+	ListenUnix  string         `toml:"listen_unix"`
+	UnixMode    os.FileMode    `toml:"listen_unix_mode"`
+	ListenDebug string         `toml:"listen_debug"`
+	WaitTimeout time.Duration  `toml:"wait_timeout"`
+	CloseWait   time.Duration  `toml:"close_timeout"`
+	Key         string         `toml:"key"`
+	DestDir     string         `toml:"destdir"`
+	DestDirMode os.FileMode    `toml:"destdir_mode"`
+	FileMode    os.FileMode    `toml:"file_mode"`
+	FileOwner   string         `toml:"file_owner"`
+	FileGroup   string         `toml:"file_group"`
+	LogFile     string         `toml:"logfile"`
+	SourceDir   bool           `toml:"source_dir"`
+	AuditLog    bool           `toml:"audit_log"`
+	MaxConns    int            `toml:"max_connections"`
+	AcceptNum   int            `toml:"accept_workers"`
+	RateLimit   int            `toml:"rate_limit"`
+	RateMode    string         `toml:"rate_limit_mode"`
+	PathTpl     string         `toml:"path_template"`
+	WriteBuffer int            `toml:"write_buffer"`
+	FlushLines  int            `toml:"flush_lines"`
+	RotateName  string         `toml:"rotate_name"`
+	RotateMiss  string         `toml:"rotate_missing"`
+	RotateComp  string         `toml:"rotate_compress"`
+	CompWorkers int            `toml:"compress_workers"`
+	CompQueue   int            `toml:"compress_queue"`
+	CompPolicy  string         `toml:"compress_queue_policy"`
+	SyncEvery   int            `toml:"sync_every"`
+	FullPause   time.Duration  `toml:"disk_full_pause"`
+	OpenRetries int            `toml:"open_retries"`
+	HookCmd     string         `toml:"post_rotate_command"`
+	HookURL     string         `toml:"post_rotate_url"`
+	HookRetries int            `toml:"post_rotate_retries"`
+	HookBackoff time.Duration  `toml:"post_rotate_backoff"`
+	HookTimeout time.Duration  `toml:"post_rotate_timeout"`
+	HookQueue   int            `toml:"post_rotate_queue"`
+	HookPolicy  string         `toml:"post_rotate_queue_policy"`
+	KeepIdle    time.Duration  `toml:"tcp_keepalive_idle"`
+	KeepIntvl   time.Duration  `toml:"tcp_keepalive_interval"`
+	NoDelay     bool           `toml:"tcp_nodelay"`
+	Filters     []FilterConfig `toml:"filter"`
+	Samples     []SampleConfig `toml:"sample"`
+	Dedups      []DedupConfig  `toml:"dedup"`
+	Stamps      []StampConfig  `toml:"timestamp"`
+	LineOrder   []string       `toml:"transform_order"`
+	DetectGzip  bool           `toml:"detect_gzip"`
+	FwdTo       string         `toml:"forward_to"`
+	FwdKey      string         `toml:"forward_key"`
+	FwdQueue    int            `toml:"forward_queue_bytes"`
 }
 
 func newConfig() *Config {
 	config := &Config{}
 	config.Listen = "0.0.0.0:1466"
+	config.ListenList = []string{}
+	config.ListenUnix = ""
+	config.UnixMode = 0660
 	config.ListenDebug = ""
 	config.WaitTimeout = 60
+	config.CloseWait = 10
 	config.Key = "key"
 	config.DestDir = "./logs"
 	config.DestDirMode = 0755
+	config.FileMode = 0644
+	config.FileOwner = ""
+	config.FileGroup = ""
 	config.LogFile = ""
+	config.SourceDir = false
+	config.AuditLog = false
+	config.MaxConns = 0
+	config.AcceptNum = 1
+	config.RateLimit = 0
+	config.RateMode = "block"
+	config.PathTpl = "{dir}/{name}"
+	config.WriteBuffer = os.Getpagesize()
+	config.FlushLines = 0
+	config.RotateName = "timestamp"
+	config.RotateMiss = "skip"
+	config.RotateComp = ""
+	config.CompWorkers = 1
+	config.CompQueue = 1024
+	config.CompPolicy = "block"
+	config.SyncEvery = 0
+	config.FullPause = 10
+	config.OpenRetries = 3
+	config.HookCmd = ""
+	config.HookURL = ""
+	config.HookRetries = 3
+	config.HookBackoff = 5
+	config.HookTimeout = 60
+	config.HookQueue = 1024
+	config.HookPolicy = "block"
+	config.KeepIdle = 0
+	config.KeepIntvl = 0
+	config.NoDelay = true
+	config.Filters = []FilterConfig{}
+	config.Samples = []SampleConfig{}
+	config.Dedups = []DedupConfig{}
+	config.Stamps = []StampConfig{}
+	config.LineOrder = []string{"filter", "sample"}
+	config.DetectGzip = false
+	config.FwdTo = ""
+	config.FwdKey = ""
+	config.FwdQueue = 64 * 1024 * 1024
 	return config
 }
 
@@ -75,20 +423,161 @@ func main() {
 		os.Exit(1)
 	}
 
+	// environment overrides config file, e.g. LOGCARRIER_DESTDIR=/var/log/remote
+	if err := config.ParseEnv(cfg, "LOGCARRIER"); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	if len(cfg.LogFile) > 0 {
 		loggingConfig := logging.NewConfig()
 		loggingConfig.Logfile = cfg.LogFile
-		logging.SetConfig(loggingConfig)
+		if err := logging.SetConfig(loggingConfig); err != nil {
+			// storage keeps working, only logs go elsewhere
+			logging.Warning("Can't open logfile %s, logging to stderr: %s", cfg.LogFile, err)
+		}
 	}
 
 	logging.Info("Started")
 
+	if cfg.AcceptNum < 1 {
+		fmt.Fprintf(os.Stderr, "Error: accept_workers must be positive\n")
+		os.Exit(1)
+	}
+
+	if cfg.RateMode != "block" && cfg.RateMode != "drop" {
+		fmt.Fprintf(os.Stderr, "Error: Unknown rate_limit_mode %v\n", cfg.RateMode)
+		os.Exit(1)
+	}
+
+	if _, ok := rotateNamers[cfg.RotateName]; !ok {
+		fmt.Fprintf(os.Stderr, "Error: Unknown rotate_name %v\n", cfg.RotateName)
+		os.Exit(1)
+	}
+
+	if cfg.RotateMiss != "skip" && cfg.RotateMiss != "create" && cfg.RotateMiss != "error" {
+		fmt.Fprintf(os.Stderr, "Error: Unknown rotate_missing %v\n", cfg.RotateMiss)
+		os.Exit(1)
+	}
+
+	if cfg.RotateComp != "" && cfg.RotateComp != "gzip" {
+		fmt.Fprintf(os.Stderr, "Error: Unknown rotate_compress %v\n", cfg.RotateComp)
+		os.Exit(1)
+	}
+
+	compPolicy, err := queue.ParsePolicy(cfg.CompPolicy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: compress_queue_policy: %v\n", err)
+		os.Exit(1)
+	}
+
+	hookPolicy, err := queue.ParsePolicy(cfg.HookPolicy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: post_rotate_queue_policy: %v\n", err)
+		os.Exit(1)
+	}
+
+	if cfg.HookCmd != "" && strings.TrimSpace(cfg.HookCmd) == "" {
+		fmt.Fprintf(os.Stderr, "Error: post_rotate_command is blank\n")
+		os.Exit(1)
+	}
+
+	for _, fc := range cfg.Filters {
+		if _, err := filepath.Match(fc.Match, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: filter match %#v: %v\n", fc.Match, err)
+			os.Exit(1)
+		}
+		filter, err := lines.NewFilter(fc.DropSubstr, fc.DropRegexp)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: filter %#v: %v\n", fc.Match, err)
+			os.Exit(1)
+		}
+		lineFilters = append(lineFilters, lineFilter{match: fc.Match, filter: filter})
+	}
+
+	for _, sc := range cfg.Samples {
+		if _, err := filepath.Match(sc.Match, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: sample match %#v: %v\n", sc.Match, err)
+			os.Exit(1)
+		}
+		if sc.Rate < 1 || (sc.Mode != "every" && sc.Mode != "random") {
+			fmt.Fprintf(os.Stderr, "Error: sample %#v: rate must be positive and mode every or random\n", sc.Match)
+			os.Exit(1)
+		}
+	}
+	sampleConfigs = cfg.Samples
+
+	for _, dc := range cfg.Dedups {
+		if _, err := filepath.Match(dc.Match, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: dedup match %#v: %v\n", dc.Match, err)
+			os.Exit(1)
+		}
+		if dc.Window <= 0 || dc.MaxLine <= 0 {
+			fmt.Fprintf(os.Stderr, "Error: dedup %#v: window and max_line must be positive\n", dc.Match)
+			os.Exit(1)
+		}
+	}
+	dedupConfigs = cfg.Dedups
+
+	for _, sc := range cfg.Stamps {
+		if _, err := filepath.Match(sc.Match, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: timestamp match %#v: %v\n", sc.Match, err)
+			os.Exit(1)
+		}
+		if sc.Format == "" {
+			fmt.Fprintf(os.Stderr, "Error: timestamp %#v: format is required\n", sc.Match)
+			os.Exit(1)
+		}
+	}
+	stampConfigs = cfg.Stamps
+
+	if err := checkTransformOrder(cfg.LineOrder); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// write_buffer is kept in whole pages. Flushes are not page aligned even so,
+	// files are appended to at arbitrary offsets
+	if page := os.Getpagesize(); cfg.WriteBuffer <= 0 || cfg.WriteBuffer%page != 0 {
+		size := page
+		if cfg.WriteBuffer > page {
+			size = (cfg.WriteBuffer + page - 1) / page * page
+		}
+		logging.Warning("write_buffer %d is not a multiple of page size %d, using %d", cfg.WriteBuffer, page, size)
+		cfg.WriteBuffer = size
+	}
+
+	if err := checkPathTemplate(cfg.PathTpl, cfg.DestDir); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if cfg.FileOwner != "" {
+		owner, err := user.Lookup(cfg.FileOwner)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: file_owner: %v\n", err)
+			os.Exit(1)
+		}
+		fileUID, _ = strconv.Atoi(owner.Uid)
+		fileGID, _ = strconv.Atoi(owner.Gid)
+	}
+
+	if cfg.FileGroup != "" {
+		group, err := user.LookupGroup(cfg.FileGroup)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: file_group: %v\n", err)
+			os.Exit(1)
+		}
+		fileGID, _ = strconv.Atoi(group.Gid)
+	}
+
 	if !PathExists(cfg.DestDir) {
 		fmt.Fprintf(os.Stderr, "Error: Directory %v not exists\n", cfg.DestDir)
 		os.Exit(1)
 	}
 
 	if len(cfg.ListenDebug) > 0 {
+		http.Handle("/debug/streams", active)
 		logging.Info("Debug listening on " + cfg.ListenDebug)
 		go func() {
 			http.ListenAndServe(cfg.ListenDebug, nil)
@@ -98,32 +587,103 @@ func main() {
 	signalChannel := make(chan os.Signal, 2)
 	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
 
-	l, err := net.Listen("tcp", cfg.Listen)
-	if err != nil {
-		logging.Critical("Error listening: %s", err.Error())
-		os.Exit(1)
+	listenAddrs := cfg.ListenList
+	if len(cfg.Listen) > 0 {
+		listenAddrs = append([]string{cfg.Listen}, listenAddrs...)
 	}
 
-	defer l.Close()
-	logging.Info("Listening on " + cfg.Listen)
-	acceptConn := true
+	listeners := []net.Listener{}
+	for _, addr := range listenAddrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			logging.Critical("Error listening %s: %s", addr, err.Error())
+			os.Exit(1)
+		}
+		logging.Info("Listening on " + addr)
+		listeners = append(listeners, l)
+	}
+	if cfg.ListenUnix != "" {
+		l, err := listenUnix(cfg.ListenUnix, cfg.UnixMode)
+		if err != nil {
+			logging.Critical("Error listening %s: %s", cfg.ListenUnix, err.Error())
+			os.Exit(1)
+		}
+		logging.Info("Listening on " + cfg.ListenUnix)
+		listeners = append(listeners, l)
+	}
 
-	locks := &Locks{
-		fmap: make(map[string]*sync.RWMutex),
+	writerPool.New = func() interface{} {
+		return bufio.NewWriterSize(nil, cfg.WriteBuffer)
 	}
 
-	go func() {
-		for {
-			conn, err := l.Accept()
-			if err != nil {
-				logging.Critical("Error accepting: %s", err.Error())
+	if cfg.HookCmd != "" || cfg.HookURL != "" {
+		postRotate = hook.NewHook(hook.Config{
+			Command: cfg.HookCmd,
+			URL:     cfg.HookURL,
+			Retries: cfg.HookRetries,
+			Backoff: cfg.HookBackoff * time.Second,
+			Timeout: cfg.HookTimeout * time.Second,
+		}, 1, queue.NewQueue(cfg.HookQueue, hookPolicy))
+		expvar.Publish("post_rotate", expvar.Func(func() interface{} {
+			return map[string]int64{
+				"backlog":  postRotate.Backlog(),
+				"dropped":  postRotate.Dropped(),
+				"failures": postRotate.Failures(),
 			}
-			go handleRequest(conn, cfg, locks)
-			if !acceptConn {
-				break
+		}))
+	}
+
+	if cfg.RotateComp != "" {
+		var done func(queue.Job)
+		if postRotate != nil {
+			done = postRotate.Push
+		}
+		perm := compress.Perm{Mode: cfg.FileMode, UID: fileUID, GID: fileGID}
+		compressor = compress.NewPool(cfg.CompWorkers, queue.NewQueue(cfg.CompQueue, compPolicy), perm, done)
+		expvar.Publish("compress", expvar.Func(func() interface{} {
+			return map[string]int64{
+				"backlog":  compressor.Backlog(),
+				"dropped":  compressor.Dropped(),
+				"failures": compressor.Failures(),
 			}
+		}))
+	}
+
+	if cfg.FwdTo != "" {
+		key := cfg.FwdKey
+		if key == "" {
+			key = cfg.Key
 		}
-	}()
+		forwarder = forward.NewForwarder(cfg.FwdTo, key, cfg.WaitTimeout*time.Second, cfg.FwdQueue)
+		expvar.Publish("forward", expvar.Func(func() interface{} {
+			return map[string]int64{
+				"queued_bytes": int64(forwarder.QueuedBytes()),
+				"lag_ms":       int64(forwarder.Lag() / time.Millisecond),
+				"errors":       forwarder.Errors(),
+				"dropped":      forwarder.Dropped(),
+				"rejected":     forwarder.Rejected(),
+				"skipped":      forwarder.Skipped(),
+			}
+		}))
+	}
+
+	locks := newLocks()
+
+	// ctx is cancelled when shutdown waited too long for running requests
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stopping := make(chan bool)
+	go locks.evictLoop(stopping)
+	acceptWg := &sync.WaitGroup{}
+	// Accept is safe to call concurrently, connection counting is atomic.
+	// Backlog size is taken by Go from net.core.somaxconn
+	for _, l := range listeners {
+		for i := 0; i < cfg.AcceptNum; i++ {
+			acceptWg.Add(1)
+			go acceptLoop(ctx, l, cfg, locks, stopping, acceptWg)
+		}
+	}
 
 sigLoop:
 	for {
@@ -131,21 +691,54 @@ sigLoop:
 		switch sig {
 		case os.Interrupt:
 			logging.Info("SIGINT received")
-			acceptConn = false
 			break sigLoop
 		case syscall.SIGTERM:
 			logging.Info("SIGTERM received")
-			acceptConn = false
 			break sigLoop
 		}
 	}
 
+	close(stopping)
+	for _, l := range listeners {
+		l.Close()
+	}
+	acceptWg.Wait()
+
+	if pending := active.Snapshot(); len(pending) > 0 {
+		var plines, pbytes int64
+		for _, p := range pending {
+			plines += p.Lines
+			pbytes += p.Bytes
+		}
+		logging.Info("Finishing %d requests, %d lines %d bytes received", len(pending), plines, pbytes)
+	}
+
+	// closing connections does not help request stuck on flush or fsync
+	// of a wedged disk, such requests are abandoned after close_timeout
+	// more
+	abandon := make(chan bool)
+	timeout := time.AfterFunc(cfg.WaitTimeout*time.Second, func() {
+		logging.Error("Requests not finished in %s, closing connections", cfg.WaitTimeout*time.Second)
+		cancel()
+		time.AfterFunc(cfg.CloseWait*time.Second, func() { close(abandon) })
+	})
+	defer timeout.Stop()
+
 	i := 0
+waitLoop:
 	for {
 		lcnt := atomic.LoadInt32(&locksCount)
 		if lcnt < 1 {
 			break
 		}
+		select {
+		case <-abandon:
+			for _, p := range active.Snapshot() {
+				logging.Error("%s %s abandoned, %d lines %d bytes", p.Remote, p.Name, p.Lines, p.Bytes)
+			}
+			break waitLoop
+		default:
+		}
 		if i == 0 {
 			logging.Info("Waiting for %d locks", lcnt)
 		}
@@ -156,15 +749,557 @@ sigLoop:
 		time.Sleep(100 * time.Millisecond)
 	}
 
+	if compressor != nil {
+		if backlog := compressor.Backlog(); backlog > 0 {
+			logging.Info("Waiting for %d files compression", backlog)
+		}
+		compressor.Stop()
+	}
+
+	if postRotate != nil {
+		if backlog := postRotate.Backlog(); backlog > 0 {
+			logging.Info("Waiting for %d post-rotate hooks", backlog)
+		}
+		postRotate.Stop(cfg.WaitTimeout * time.Second)
+	}
+
+	if forwarder != nil {
+		if queued := forwarder.Stop(); queued > 0 {
+			logging.Error("%d bytes were not forwarded to %s", queued, cfg.FwdTo)
+		}
+	}
+
 	logging.Info("EXIT")
 }
 
+// acceptLoop accepts connections on l until stopping is closed.
+// Accept errors like EMFILE persist for a while, so they are retried
+// after a pause growing from 5ms to 1s, as net/http does
+func acceptLoop(ctx context.Context, l net.Listener, cfg *Config, locks *Locks, stopping chan bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+	var pause time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-stopping:
+				return
+			default:
+			}
+			if pause == 0 {
+				pause = 5 * time.Millisecond
+			} else if pause *= 2; pause > time.Second {
+				pause = time.Second
+			}
+			logging.Critical("Error accepting, retry in %s: %s", pause, err.Error())
+			select {
+			case <-time.After(pause):
+			case <-stopping:
+				return
+			}
+			continue
+		}
+		pause = 0
+		tuneConn(conn, cfg)
+		if !acquireConn(cfg.MaxConns) {
+			logging.Error("%s rejected: too many connections", conn.RemoteAddr())
+			conn.Write([]byte("400 Busy\n"))
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer atomic.AddInt32(&connsCount, -1)
+			handleRequest(ctx, conn, cfg, locks, stopping)
+		}()
+	}
+}
+
+// listenUnix listens unix socket path, stale socket left by killed process
+// is removed. Socket file is removed when listener is closed
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if st, err := os.Lstat(path); err == nil {
+		if st.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// tuneConn applies TCP options from config, connections of other types are left as is
+func tuneConn(conn net.Conn, cfg *Config) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tcpConn.SetNoDelay(cfg.NoDelay); err != nil {
+		logging.Warning("%s SetNoDelay: %s", conn.RemoteAddr(), err)
+	}
+	if cfg.KeepIdle > 0 {
+		intvl := cfg.KeepIntvl
+		if intvl <= 0 {
+			intvl = cfg.KeepIdle
+		}
+		if err := keepalive.Set(tcpConn, cfg.KeepIdle*time.Second, intvl*time.Second); err != nil {
+			logging.Warning("%s SetKeepAlive: %s", conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// acquireConn counts new connection, returns false if limit (when non-zero) is exceeded
+func acquireConn(limit int) bool {
+	cnt := atomic.AddInt32(&connsCount, 1)
+	if limit > 0 && int(cnt) > limit {
+		atomic.AddInt32(&connsCount, -1)
+		return false
+	}
+	for {
+		peak := atomic.LoadInt32(&connsPeak)
+		if cnt <= peak || atomic.CompareAndSwapInt32(&connsPeak, peak, cnt) {
+			return true
+		}
+	}
+}
+
+// throttle accounts n bytes in limit (nil means unlimited).
+// In drop mode it returns false if the bytes are over the limit, the caller drops
+// them and keeps the rest of the request. In block mode
+// the request sleeps until bytes over the rate are paid off, so it is slowed down
+// itself. Only writers of the same file wait for its lock meanwhile.
+// Shutdown (closed stopping) ends the sleep, so the request is finished quickly
+func throttle(limit *ratelimit.Bucket, mode string, n int, stopping chan bool) bool {
+	if limit == nil {
+		return true
+	}
+	if mode == "drop" {
+		if limit.TryTake(n) {
+			return true
+		}
+		throttledBytes.Add(int64(n))
+		return false
+	}
+	wait := limit.Take(n)
+	if wait <= 0 {
+		return true
+	}
+	throttledBytes.Add(int64(n))
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-stopping:
+	}
+	return true
+}
+
+// lineLimiter drops protocol 2 data over drop mode limit by whole lines.
+// A line is kept or dropped as decided on its first bytes, so no line is torn
+type lineLimiter struct {
+	limit   *ratelimit.Bucket
+	midLine bool
+	keep    bool
+	dropped int
+}
+
+// Keep returns part of data within the limit, moved to the start of data
+func (l *lineLimiter) Keep(data []byte) []byte {
+	if l.limit == nil {
+		return data
+	}
+	kept := data[:0]
+	for len(data) > 0 {
+		n := bytes.IndexByte(data, '\n') + 1
+		if n == 0 {
+			n = len(data)
+		}
+		if !l.midLine {
+			l.keep = throttle(l.limit, "drop", n, nil)
+		} else if l.keep {
+			// rest of a kept line is taken in debt
+			l.limit.Take(n)
+		} else {
+			throttledBytes.Add(int64(n))
+		}
+		if l.keep {
+			kept = append(kept, data[:n]...)
+		} else {
+			l.dropped += n
+		}
+		l.midLine = data[n-1] != '\n'
+		data = data[n:]
+	}
+	return kept
+}
+
+// openFile opens fpath for appending. Files created by it get mode and owner from config,
+// a new file is removed again if that fails, so it never stays with default permissions
+func openFile(fpath string, mode os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(fpath, fileflag|os.O_EXCL, mode)
+	if os.IsExist(err) {
+		return os.OpenFile(fpath, fileflag, mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// explicit chmod, created mode is affected by umask
+	err = f.Chmod(mode)
+	if err == nil && (fileUID >= 0 || fileGID >= 0) {
+		err = f.Chown(fileUID, fileGID)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(fpath)
+		return nil, fmt.Errorf("can't set permissions of %s: %s", fpath, err)
+	}
+	return f, nil
+}
+
+// dropCounter counts lines dropped by Transformer, for per-request stats
+type dropCounter struct {
+	lines.Transformer
+	dropped *int
+}
+
+func (d dropCounter) Transform(line []byte) ([]byte, bool) {
+	line, keep := d.Transformer.Transform(line)
+	if !keep {
+		*d.dropped++
+	}
+	return line, keep
+}
+
+// findFilter returns first filter matching stream dname/fname, nil if none
+func findFilter(dname string, fname string) *lines.Filter {
+	for _, lf := range lineFilters {
+		if ok, _ := filepath.Match(lf.match, dname+"/"+fname); ok {
+			return lf.filter
+		}
+	}
+	return nil
+}
+
+// findStamper returns timestamper of stream dname/fname, nil if lines of stream are not stamped
+func findStamper(dname string, fname string) *lines.Stamper {
+	for _, sc := range stampConfigs {
+		if ok, _ := filepath.Match(sc.Match, dname+"/"+fname); ok {
+			return lines.NewStamper(sc.Format)
+		}
+	}
+	return nil
+}
+
+// newDedup returns deduplicator for a request to stream dname/fname, nil if stream is not deduplicated
+func newDedup(dname string, fname string) *lines.Dedup {
+	for _, dc := range dedupConfigs {
+		if ok, _ := filepath.Match(dc.Match, dname+"/"+fname); ok {
+			return lines.NewDedup(dc.Window*time.Second, dc.MaxLine)
+		}
+	}
+	return nil
+}
+
+// bufferedAfter returns occupancy w reaches writing n bytes, write_buffer
+// means the buffer fills up and is flushed in the middle of the write
+func bufferedAfter(w *bufio.Writer, n int) int {
+	if b := w.Buffered() + n; b < w.Size() {
+		return b
+	}
+	return w.Size()
+}
+
+// openRetry opens fpath with openFile, transient failures are retried
+// open_retries times with growing pause. Directory removed meanwhile is
+// created again
+func openRetry(fpath string, cfg *Config) (*os.File, error) {
+	pause := 100 * time.Millisecond
+	for i := 0; ; i++ {
+		f, err := openFile(fpath, cfg.FileMode)
+		if err == nil {
+			return f, nil
+		}
+		if i >= cfg.OpenRetries || !transientOpenError(err) {
+			openFailures.Add(1)
+			return nil, err
+		}
+		openRetries.Add(1)
+		logging.Warning("Can't open file %s, retry in %s: %s", fpath, pause, err)
+		time.Sleep(pause)
+		pause *= 2
+		if os.IsNotExist(err) {
+			os.MkdirAll(filepath.Dir(fpath), cfg.DestDirMode)
+		}
+	}
+}
+
+// transientOpenError reports whether open may succeed if repeated,
+// permission errors and the like are not
+func transientOpenError(err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+	if perr, ok := err.(*os.PathError); ok {
+		switch perr.Err {
+		case syscall.EAGAIN, syscall.EINTR, syscall.EMFILE, syscall.ENFILE:
+			return true
+		}
+	}
+	return false
+}
+
+// noteDiskFull pauses DATA requests for pause seconds if err is ENOSPC.
+// Requests after the pause probe whether space was freed
+func noteDiskFull(err error, pause time.Duration) {
+	if !errors.Is(err, syscall.ENOSPC) {
+		return
+	}
+	if !diskFull() {
+		logging.Error("No space left on device, pausing DATA requests for %s", pause*time.Second)
+	}
+	atomic.StoreInt64(&fullUntil, time.Now().Add(pause*time.Second).UnixNano())
+}
+
+func diskFull() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&fullUntil)
+}
+
+// syncFile calls fsync on f and accounts its duration
+func syncFile(f *os.File) error {
+	start := time.Now()
+	err := f.Sync()
+	usec := int64(time.Since(start) / time.Microsecond)
+
+	fsyncCount.Add(1)
+	fsyncTime.Add(usec)
+	if usec > fsyncMaxTime.Value() {
+		fsyncMaxTime.Set(usec)
+	}
+	return err
+}
+
+// transformStages line stages ordered by transform_order
+var transformStages = []string{"filter", "sample"}
+
+// checkTransformOrder validates transform_order: every stage is listed exactly once,
+// a missing one would silently turn its rules off. Dedup and timestamp are not
+// orderable: dedup turns one line into zero or more and holds the repeats summary
+// until the next line, timestamp has to follow dedup or no two stamped lines are equal
+func checkTransformOrder(order []string) error {
+	seen := map[string]bool{}
+	for _, name := range order {
+		known := false
+		for _, stage := range transformStages {
+			known = known || name == stage
+		}
+		if !known {
+			return fmt.Errorf("unknown transform_order stage %v", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("transform_order lists %v twice", name)
+		}
+		seen[name] = true
+	}
+	for _, stage := range transformStages {
+		if !seen[stage] {
+			return fmt.Errorf("transform_order misses %v", stage)
+		}
+	}
+	return nil
+}
+
+// checkPathTemplate validates path_template: it must name the file, use only known tokens
+// and keep files inside destDir
+func checkPathTemplate(tpl string, destDir string) error {
+	for _, token := range pathTemplateBraces.FindAllString(tpl, -1) {
+		m := pathTemplateToken.FindStringSubmatch(token)
+		if m == nil || m[0] != token || !pathTemplateTokens[m[1]] || (m[1] == "field") != (m[2] != "") {
+			return fmt.Errorf("unknown token %s in path_template %#v", token, tpl)
+		}
+	}
+	if !strings.Contains(tpl, "{name}") {
+		return fmt.Errorf("path_template %#v must contain {name}", tpl)
+	}
+	fields := map[string]string{}
+	for _, name := range templateFields(tpl) {
+		fields[name] = "field"
+	}
+	// names from header can't leave destdir, so a sample one shows where the template leads
+	sample, _ := filepath.Abs(filepath.Join(destDir, renderPath(tpl, time.Now(), "group", "dir", "name", fields)))
+	destDirAbs, _ := filepath.Abs(destDir)
+	if !insideDir(sample, destDirAbs) {
+		return fmt.Errorf("path_template %#v leads outside destdir", tpl)
+	}
+	return nil
+}
+
+// templateFields returns names of header fields used by path_template, they are required in requests
+func templateFields(tpl string) []string {
+	names := []string{}
+	for _, m := range pathTemplateToken.FindAllStringSubmatch(tpl, -1) {
+		if m[1] == "field" {
+			names = append(names, m[2])
+		}
+	}
+	return names
+}
+
+// renderPath builds file path relative to destdir from path_template
+func renderPath(tpl string, t time.Time, group string, dname string, fname string, fields map[string]string) string {
+	return pathTemplateToken.ReplaceAllStringFunc(tpl, func(token string) string {
+		if strings.HasPrefix(token, "{field.") {
+			return fields[token[len("{field."):len(token)-1]]
+		}
+		switch token {
+		case "{yyyy}":
+			return fmt.Sprintf("%d", t.Year())
+		case "{mm}":
+			return fmt.Sprintf("%02d", t.Month())
+		case "{dd}":
+			return fmt.Sprintf("%02d", t.Day())
+		case "{hh}":
+			return fmt.Sprintf("%02d", t.Hour())
+		case "{group}":
+			return group
+		case "{dir}":
+			return dname
+		case "{name}":
+			return fname
+		}
+		return token
+	})
+}
+
+// splitFields separates named "key=value" fields following positional fields of header
+func splitFields(args []string, positional int) ([]string, map[string]string, error) {
+	if len(args) <= positional {
+		return args, map[string]string{}, nil
+	}
+	rest := []string{}
+	fields := map[string]string{}
+	for _, arg := range args[positional:] {
+		if !strings.Contains(arg, "=") {
+			rest = append(rest, arg)
+			continue
+		}
+		m := fieldToken.FindStringSubmatch(arg)
+		if m == nil || !validName(m[2], false) {
+			return nil, nil, fmt.Errorf("malformed field %#v", arg)
+		}
+		fields[m[1]] = m[2]
+	}
+	return append(args[:positional:positional], rest...), fields, nil
+}
+
+// DataArgs optional fields of DATA header
+type DataArgs struct {
+	Protocol int
+	Bytes    int
+	Ack      bool
+}
+
+// parseDataArgs parses optional DATA header fields "[bytes] [vN] [ack]".
+// Without explicit version protocol is 2 when bytes count is given and 1 otherwise
+func parseDataArgs(args []string) (*DataArgs, error) {
+	dargs := &DataArgs{}
+	for _, arg := range args {
+		if arg == "ack" {
+			dargs.Ack = true
+		} else if protocolToken.MatchString(arg) {
+			dargs.Protocol, _ = strconv.Atoi(arg[1:])
+		} else if i, err := strconv.Atoi(arg); err == nil {
+			dargs.Bytes = i
+		}
+	}
+	switch dargs.Protocol {
+	case 0:
+		dargs.Protocol = 1
+		if dargs.Bytes > 0 {
+			dargs.Protocol = 2
+		}
+	case 1:
+		if dargs.Bytes > 0 {
+			return nil, fmt.Errorf("protocol 1 does not take bytes count")
+		}
+	case 2:
+		if dargs.Bytes <= 0 {
+			return nil, fmt.Errorf("protocol 2 requires bytes count")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported protocol %d", dargs.Protocol)
+	}
+	return dargs, nil
+}
+
+// validName checks that name from request header is safe to use in file path.
+// With allowSubdirs name may consist of several "/"-separated components.
+// Backslash is never allowed, so names can't escape destdir on windows either
+func validName(name string, allowSubdirs bool) bool {
+	parts := []string{name}
+	if allowSubdirs {
+		parts = strings.Split(name, "/")
+	}
+	for _, part := range parts {
+		if len(part) > nameMaxLen || part == "." || part == ".." || !nameChars.MatchString(part) {
+			return false
+		}
+	}
+	return true
+}
+
+// sourceName makes peer address usable as path component: zone of IPv6 address
+// is dropped and ":" is replaced with "_", as names can't contain ":"
+func sourceName(addr string) string {
+	if i := strings.IndexByte(addr, '%'); i >= 0 {
+		addr = addr[:i]
+	}
+	return strings.Replace(addr, ":", "_", -1)
+}
+
+// insideDir checks that absolute path p is located inside absolute directory dir
+func insideDir(p string, dir string) bool {
+	return strings.HasPrefix(p, dir+string(filepath.Separator))
+}
+
 // Handles incoming requests.
-func handleRequest(conn net.Conn, cfg *Config, locks *Locks) {
+func handleRequest(ctx context.Context, conn net.Conn, cfg *Config, locks *Locks, stopping chan bool) {
 	conn.SetDeadline(time.Now().Add(60 * time.Second))
 	defer conn.Close()
 
+	// closing conn on cancel interrupts blocked reads, so unfinished data gets truncated
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
 	remoteAddr, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if _, ok := conn.(*net.UnixConn); ok {
+		// unix socket peers have no address, source_dir keeps them in local/
+		remoteAddr = "local"
+	}
+
+	if cfg.AuditLog {
+		logging.Info("%s connection opened", remoteAddr)
+		defer logging.Info("%s connection closed", remoteAddr)
+	}
 
 	reader := bufio.NewReader(conn)
 	line, err := reader.ReadBytes('\n')
@@ -172,73 +1307,189 @@ func handleRequest(conn net.Conn, cfg *Config, locks *Locks) {
 		return
 	}
 
-	lineslc := strings.Fields(string(line))
+	// "key=value" after <filename> is always a field, so ROTATE new names can't contain "="
+	lineslc, fields, err := splitFields(strings.Fields(string(line)), 5)
+	if err != nil {
+		rejectedHeaders.Add(1)
+		logging.Error("%s %s", remoteAddr, err)
+		conn.Write([]byte("400 Malformed header\n"))
+		return
+	}
 	if len(lineslc) < 5 {
 		return
 	}
+	// key is checked before anything else, so unauthenticated clients
+	// can't rotate or create files
+	if lineslc[1] != cfg.Key {
+		logging.Error("%s wrong key", remoteAddr)
+		return
+	}
+	for _, name := range templateFields(cfg.PathTpl) {
+		if _, ok := fields[name]; !ok {
+			rejectedHeaders.Add(1)
+			logging.Error("%s required field %s missing", remoteAddr, name)
+			conn.Write([]byte(fmt.Sprintf("400 Missing field %s\n", name)))
+			return
+		}
+	}
 
 	acmd := lineslc[0]
-	akey := lineslc[1]
+	group := lineslc[2]
 	dname := lineslc[3]
 	fname := lineslc[4]
 	bcnt := 0
+	protocol := 1
+	ack := false
 
-	dpath := path.Join(cfg.DestDir, dname)
-	fpath := path.Join(dpath, fname)
+	if !validName(group, false) || !validName(dname, true) || !validName(fname, false) {
+		rejectedHeaders.Add(1)
+		logging.Error("%s invalid names in header: %s %s %s", remoteAddr, group, dname, fname)
+		conn.Write([]byte("400 Error\n"))
+		return
+	}
+
+	// dates in path_template are taken at request time, so ROTATE
+	// addresses the file of the current period.
+	// With source_dir enabled files of every client are kept apart,
+	// so DATA and ROTATE both address .../ip/filename
+	fpath := filepath.Join(cfg.DestDir, renderPath(cfg.PathTpl, time.Now(), group, dname, fname, fields))
+	dpath := filepath.Dir(fpath)
+	if cfg.SourceDir {
+		source := sourceName(remoteAddr)
+		if !validName(source, false) {
+			logging.Error("%s invalid source directory %s", remoteAddr, source)
+			conn.Write([]byte("400 Error\n"))
+			return
+		}
+		dpath = filepath.Join(dpath, source)
+	}
+	fpath = filepath.Join(dpath, filepath.Base(fpath))
 
 	fpathAbs, _ := filepath.Abs(fpath)
 	cfgDirAbs, _ := filepath.Abs(cfg.DestDir)
 
-	if !strings.HasPrefix(fpathAbs, cfgDirAbs) {
+	if !insideDir(fpathAbs, cfgDirAbs) {
 		logging.Error("%s unsecure file path %s => %s", remoteAddr, dname, fpathAbs)
 		return
 	}
 
 	if acmd == "DATA" {
-		if len(lineslc) > 5 { // protocol 2
-			i, err := strconv.Atoi(lineslc[5])
-			if err == nil {
-				bcnt = i
-			}
+		dargs, err := parseDataArgs(lineslc[5:])
+		if err != nil {
+			logging.Error("%s %s", remoteAddr, err)
+			conn.Write([]byte("400 Unsupported protocol\n"))
+			return
 		}
+		protocol = dargs.Protocol
+		bcnt = dargs.Bytes
+		ack = dargs.Ack
 	} else if acmd == "ROTATE" {
-		t := time.Now()
-		newfname := fmt.Sprintf("%s-%d%02d%02d%02d%02d%02d", fname, t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second())
+		// Rotated file is queued for compression and hooks only after the file lock is
+		// released (deferred calls run in reverse order). With the default "block" queue
+		// policy a full queue then holds up only this ROTATE, not DATA writers of the file.
+		// Shutdown does not wait for this push, queues stopped meanwhile reject the job.
+		rotated := ""
+		defer func() {
+			if rotated == "" {
+				return
+			}
+			job := queue.Job{Path: rotated, Group: group, Key: dname + "/" + fname}
+			if compressor != nil {
+				compressor.Push(job)
+			} else if postRotate != nil {
+				postRotate.Push(job)
+			}
+		}()
+
+		// rotation waits for running DATA requests of the file, so rotated file is complete
+		flock := locks.FileLock(fpath)
+		defer locks.Release(fpath)
+		atomic.AddInt32(&locksCount, 1)
+		flock.Lock()
+		defer atomic.AddInt32(&locksCount, -1)
+		defer flock.Unlock()
+
+		var newfname string
 		if len(lineslc) > 5 {
 			newfname = lineslc[5]
+		} else {
+			newfname = rotateNamers[cfg.RotateName](dpath, fname, time.Now())
 		}
-		newfpath := path.Join(dpath, newfname)
-		newfpathAbs, _ := filepath.Abs(newfpath)
-		if !PathExists(fpathAbs) {
-			logging.Error("Can't rename file %s: file not exists", fpathAbs)
+		if !validName(newfname, false) {
+			rejectedHeaders.Add(1)
+			logging.Error("%s invalid rotated name in header: %s", remoteAddr, newfname)
 			conn.Write([]byte("400 Error\n"))
 			return
 		}
+		newfpath := filepath.Join(dpath, newfname)
+		newfpathAbs, _ := filepath.Abs(newfpath)
+		if !PathExists(fpathAbs) {
+			// ROTATE may come before any DATA for the file
+			switch cfg.RotateMiss {
+			case "skip":
+				logging.Debug("Skip rotation of %s: file not exists", fpathAbs)
+				conn.Write([]byte("200 DONE\n"))
+				return
+			case "create":
+				os.MkdirAll(dpath, cfg.DestDirMode)
+				f, err := openFile(fpathAbs, cfg.FileMode)
+				if err != nil {
+					logging.Error("Can't create file %s: %s", fpathAbs, err)
+					conn.Write([]byte("400 Error\n"))
+					return
+				}
+				f.Close()
+			default:
+				logging.Error("Can't rename file %s: file not exists", fpathAbs)
+				conn.Write([]byte("400 Error\n"))
+				return
+			}
+		}
 		if PathExists(newfpathAbs) {
 			logging.Error("Can't rename file %s => %s: file exists", fpathAbs, newfpathAbs)
 			conn.Write([]byte("400 Error\n"))
 			return
 		}
-		if !strings.HasPrefix(newfpathAbs, cfgDirAbs) {
+		if compressor != nil && PathExists(newfpathAbs+".gz") {
+			// compressed file would be left uncompressed or clobber the existing one
+			logging.Error("Can't rename file %s => %s: file %s.gz exists", fpathAbs, newfpathAbs, newfpathAbs)
+			conn.Write([]byte("400 Error\n"))
+			return
+		}
+		if !insideDir(newfpathAbs, cfgDirAbs) {
 			logging.Error("%s unsecure file path %s => %s", remoteAddr, dname, newfpathAbs)
 			conn.Write([]byte("400 Error\n"))
 			return
 		}
-		err := os.Rename(fpathAbs, newfpathAbs)
-		if err == nil {
-			conn.Write([]byte("200 DONE\n"))
-			logging.Info("File rotated %s => %s", fpathAbs, newfpathAbs)
+		// rename is atomic only inside one filesystem, so watchers of destdir
+		// never see partially rotated file
+		if err := os.Rename(fpathAbs, newfpathAbs); err != nil {
+			if lerr, ok := err.(*os.LinkError); ok && lerr.Err == syscall.EXDEV {
+				logging.Error("Can't rename file %s => %s: not on the same filesystem", fpathAbs, newfpathAbs)
+			} else {
+				logging.Error("Can't rename file %s => %s: %s", fpathAbs, newfpathAbs, err)
+			}
+			conn.Write([]byte("400 Error\n"))
 			return
 		}
-		logging.Error("Can't rename file %s => %s", fpathAbs, newfpathAbs)
-		conn.Write([]byte("400 Error\n"))
+		if f, err := openFile(fpathAbs, cfg.FileMode); err == nil {
+			f.Close()
+		} else {
+			logging.Error("Can't create file %s after rotation: %s", fpathAbs, err)
+		}
+		conn.Write([]byte("200 DONE\n"))
+		logging.Info("File rotated %s => %s", fpathAbs, newfpathAbs)
+		rotated = newfpathAbs
 		return
 	} else {
 		logging.Error("%s unknown command", remoteAddr)
 		return
 	}
-	if akey != cfg.Key {
-		logging.Error("%s wrong key", remoteAddr)
+	if diskFull() {
+		// client keeps data and retries, new data would be truncated anyway
+		fullRejected.Add(1)
+		logging.Error("%s %s rejected: no space left on device", remoteAddr, fpathAbs)
+		conn.Write([]byte("400 Busy\n"))
 		return
 	}
 
@@ -246,50 +1497,118 @@ func handleRequest(conn net.Conn, cfg *Config, locks *Locks) {
 		os.MkdirAll(dpath, cfg.DestDirMode)
 	}
 
+	flock := locks.FileLock(fpath)
+	defer locks.Release(fpath)
+
 	locks.Lock()
-	if _, ok := locks.fmap[fpath]; !ok {
-		locks.fmap[fpath] = new(sync.RWMutex)
+	var limit *ratelimit.Bucket
+	if cfg.RateLimit > 0 {
+		if _, ok := locks.limits[fpath]; !ok {
+			locks.limits[fpath] = ratelimit.NewBucket(cfg.RateLimit, cfg.RateLimit)
+		}
+		limit = locks.limits[fpath]
 	}
-	flock := locks.fmap[fpath]
 	locks.Unlock()
 	atomic.AddInt32(&locksCount, 1)
 	flock.Lock()
 
-	const fileflag int = os.O_CREATE | os.O_APPEND | os.O_RDWR
-	const filemode os.FileMode = 0644
-	f, err := os.OpenFile(fpath, fileflag, filemode)
+	f, err := openRetry(fpath, cfg)
 	if err != nil {
-		panic(err)
+		flock.Unlock()
+		atomic.AddInt32(&locksCount, -1)
+		logging.Error("Can't open file %s: %s", fpathAbs, err)
+		noteDiskFull(err, cfg.FullPause)
+		conn.Write([]byte("400 Error\n"))
+		return
 	}
 	defer f.Close()
 	defer flock.Unlock()
 	defer atomic.AddInt32(&locksCount, -1)
 
+	stream := active.Open(fpath, remoteAddr)
+	defer active.Close(stream)
+
 	ok := false
 	linesNum := 0
+	filteredNum := 0
+	sampledNum := 0
+	dedupNum := 0
+	throttledNum := 0
 	bytesNum := 0
 	bytesNumW := 0
 	fpos, _ := f.Seek(0, 2)
-	w := bufio.NewWriter(f)
+	w := writerPool.Get().(*bufio.Writer)
+	// flushes of w are noted in stream for last_flush
+	w.Reset(stream.Writer(f))
+	defer func() {
+		// drop reference to the file and any unflushed data before reuse
+		w.Reset(nil)
+		writerPool.Put(w)
+	}()
+
+	// flushDue flushes buffer every flush_lines lines, so tailers of long
+	// requests see data before request ends. Flushed data is still
+	// truncated if request fails later
+	unflushed := 0
+	flushDue := func(n int) error {
+		if cfg.FlushLines <= 0 {
+			return nil
+		}
+		if unflushed += n; unflushed < cfg.FlushLines {
+			return nil
+		}
+		unflushed = 0
+		return w.Flush()
+	}
 
-	if bcnt > 0 { // protocol 2
+	// out also keeps a copy of stored data for forwarder, requests
+	// larger than forward_queue_bytes are not copied
+	var out io.Writer = w
+	var mirror *forward.Mirror
+	if forwarder != nil {
+		mirror = forwarder.NewMirror()
+		out = io.MultiWriter(w, mirror)
+	}
+
+	// drop mode stores what fits the limit, request itself still succeeds
+	limiter := &lineLimiter{}
+	if cfg.RateMode == "drop" {
+		limiter.limit = limit
+	}
+
+	if protocol == 2 {
 		conn.Write([]byte("200 READY protocol 2\n"))
 		brem := bcnt
+		buf := make([]byte, 1024)
 		for {
 			conn.SetDeadline(time.Now().Add(cfg.WaitTimeout * time.Second))
-			buf := make([]byte, 1024)
 			bn, err := reader.Read(buf)
 			if err != nil {
 				logging.Error("Can't read socket on %s: %s", fpathAbs, err)
 				break
 			}
-			bnw, err := w.Write(buf[:bn])
+			data := limiter.Keep(buf[:bn])
+			stream.NoteBuffered(bufferedAfter(w, len(data)))
+			bnw, err := out.Write(data)
 			if err != nil {
 				logging.Error("Can't write to %s: %s", fpathAbs, err)
+				noteDiskFull(err, cfg.FullPause)
 				break
 			}
 			bytesNum += bn
 			bytesNumW += bnw
+			lines := bytes.Count(data, []byte{'\n'})
+			linesNum += lines
+			stream.AddLines(lines)
+			stream.AddBytes(bn)
+			if err := flushDue(lines); err != nil {
+				logging.Error("Can't write to %s: %s", fpathAbs, err)
+				noteDiskFull(err, cfg.FullPause)
+				break
+			}
+			if cfg.RateMode == "block" {
+				throttle(limit, cfg.RateMode, bn, stopping)
+			}
 			brem -= bn
 			if brem == 0 {
 				if bytesNum == bcnt {
@@ -301,16 +1620,78 @@ func handleRequest(conn net.Conn, cfg *Config, locks *Locks) {
 			}
 		}
 	} else { // protocol 1
+		// filter and sample run in transform_order on raw lines, dedup
+		// compares their output and timestamp applies to what gets written
+		stages := map[string]lines.Transformer{}
+		if filter := findFilter(dname, fname); filter != nil {
+			stages["filter"] = dropCounter{filter, &filteredNum}
+		}
+		if sampler := locks.Sampler(fpath, dname, fname); sampler != nil {
+			stages["sample"] = dropCounter{sampler, &sampledNum}
+		}
+		chain := lines.Chain{}
+		for _, name := range cfg.LineOrder {
+			if t, ok := stages[name]; ok {
+				chain = append(chain, t)
+			}
+		}
+		dedup := newDedup(dname, fname)
+		stamper := findStamper(dname, fname)
+
+		// writeLines stores lines, returns false if request has to be aborted
+		writeLines := func(lns [][]byte) bool {
+			for _, line := range lns {
+				if stamper != nil {
+					line, _ = stamper.Transform(line)
+				}
+				if !throttle(limit, cfg.RateMode, len(line), stopping) {
+					throttledNum++
+					continue
+				}
+				stream.NoteBuffered(bufferedAfter(w, len(line)))
+				bn, err := out.Write(line)
+				if err != nil {
+					logging.Error("Can't write to %s: %s", fpathAbs, err)
+					noteDiskFull(err, cfg.FullPause)
+					return false
+				}
+				bytesNum += bn
+				linesNum++
+				stream.AddLines(1)
+				stream.AddBytes(bn)
+				if err := flushDue(1); err != nil {
+					logging.Error("Can't write to %s: %s", fpathAbs, err)
+					noteDiskFull(err, cfg.FullPause)
+					return false
+				}
+			}
+			return true
+		}
+
 		conn.Write([]byte("200 READY\n"))
+		first := true
 		for {
 			conn.SetDeadline(time.Now().Add(cfg.WaitTimeout * time.Second))
 			line, err := reader.ReadBytes('\n')
 			if err != nil {
 				break
 			}
+			if first && cfg.DetectGzip && bytes.HasPrefix(line, gzipMagic) {
+				// compressed payload has no lines, line stages would corrupt it.
+				// Dot-stuffing still applies, protocol 2 is the safe way for it
+				logging.Info("%s %s/%s gzip data, stored verbatim", remoteAddr, dname, fname)
+				chain, dedup, stamper = nil, nil, nil
+			}
+			first = false
 			if line[0] == '.' {
 				tline := bytes.TrimRight(line, "\n\r")
 				if len(tline) == 1 {
+					// repeats summary of the last line belongs to this request
+					if dedup != nil {
+						if summary := dedup.Flush(); summary != nil && !writeLines([][]byte{summary}) {
+							break
+						}
+					}
 					ok = true
 					break
 				}
@@ -318,26 +1699,70 @@ func handleRequest(conn net.Conn, cfg *Config, locks *Locks) {
 					line = line[1:]
 				}
 			}
-			bn, err := w.Write(line)
-			if err != nil {
-				logging.Error("Can't write to %s: %s", fpathAbs, err)
+			var keep bool
+			if line, keep = chain.Transform(line); !keep {
+				continue
+			}
+			lns := [][]byte{line}
+			if dedup != nil {
+				if lns = dedup.Push(line, time.Now()); len(lns) == 0 {
+					dedupNum++
+				}
+			}
+			if !writeLines(lns) {
 				break
 			}
-			bytesNum += bn
-			linesNum++
 		}
 	}
 	if ok {
-		w.Flush()
-		if bcnt > 0 { // protocol 2
+		if err := w.Flush(); err != nil {
+			logging.Error("Can't write to %s: %s", fpathAbs, err)
+			noteDiskFull(err, cfg.FullPause)
+			ok = false
+		} else if ack || (cfg.SyncEvery > 0 && locks.SyncDue(fpath, cfg.SyncEvery)) {
+			// ack means data is on disk, not only in page cache
+			if err := syncFile(f); err != nil {
+				logging.Error("Can't sync %s: %s", fpathAbs, err)
+				noteDiskFull(err, cfg.FullPause)
+				ok = false
+			}
+		}
+	}
+	if ok {
+		if protocol == 2 {
 			logging.Info("%s %s/%s %d", remoteAddr, dname, fname, bytesNum)
-			if bytesNum != bytesNumW {
+			if bytesNum-limiter.dropped != bytesNumW {
 				logging.Error("Read bytes are not equals write bytes: %s %s %s", fname, bytesNum, bytesNumW)
 			}
+			if limiter.dropped > 0 {
+				logging.Warning("%s %s/%s bytes over rate limit dropped: %d", remoteAddr, dname, fname, limiter.dropped)
+			}
 		} else {
 			logging.Info("%s %s/%s %d %d", remoteAddr, dname, fname, linesNum, bytesNum)
+			if filteredNum > 0 {
+				filteredLines.Add(int64(filteredNum))
+				logging.Info("%s %s/%s lines filtered: %d", remoteAddr, dname, fname, filteredNum)
+			}
+			if sampledNum > 0 {
+				sampledLines.Add(int64(sampledNum))
+				logging.Debug("%s %s/%s lines sampled out: %d", remoteAddr, dname, fname, sampledNum)
+			}
+			if dedupNum > 0 {
+				dedupLines.Add(int64(dedupNum))
+				logging.Debug("%s %s/%s lines deduplicated: %d", remoteAddr, dname, fname, dedupNum)
+			}
+			if throttledNum > 0 {
+				logging.Warning("%s %s/%s lines over rate limit dropped: %d", remoteAddr, dname, fname, throttledNum)
+			}
+		}
+		if mirror != nil {
+			forwarder.Push(group, dname, fname, fields, mirror)
+		}
+		if ack {
+			conn.Write([]byte(fmt.Sprintf("200 OK %d\n", linesNum)))
+		} else {
+			conn.Write([]byte("200 OK\n"))
 		}
-		conn.Write([]byte("200 OK\n"))
 	} else {
 		f.Truncate(fpos)
 		logging.Error("%s %s file truncated", remoteAddr, fpath)
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"./compress"
+	"./queue"
+	"./ratelimit"
+)
+
+// newTestConfig returns default config writing into temporary destdir
+func newTestConfig(t *testing.T) *Config {
+	cfg := newConfig()
+	cfg.DestDir = t.TempDir()
+	writerPool.New = func() interface{} {
+		return bufio.NewWriterSize(nil, cfg.WriteBuffer)
+	}
+	return cfg
+}
+
+// request sends header head to handleRequest over a pipe and body after READY reply.
+// Returns all replies of the storage
+func request(t *testing.T, cfg *Config, locks *Locks, head string, body string) []string {
+	client, server := net.Pipe()
+	go handleRequest(context.Background(), server, cfg, locks, make(chan bool))
+	defer client.Close()
+
+	if _, err := client.Write([]byte(head + "\n")); err != nil {
+		t.Fatalf("%s: write header: %s", head, err)
+	}
+	reader := bufio.NewReader(client)
+	replies := []string{}
+	for {
+		reply, err := reader.ReadString('\n')
+		if err != nil {
+			return replies
+		}
+		replies = append(replies, strings.TrimSuffix(reply, "\n"))
+		if strings.HasPrefix(reply, "200 READY") && body != "" {
+			if _, err := client.Write([]byte(body)); err != nil {
+				t.Fatalf("%s: write body: %s", head, err)
+			}
+		}
+	}
+}
+
+// readFile returns content of file name inside destdir of cfg
+func readFile(t *testing.T, cfg *Config, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(cfg.DestDir, name))
+	if err != nil {
+		t.Fatalf("read %s: %s", name, err)
+	}
+	return string(data)
+}
+
+func TestValidName(t *testing.T) {
+	tests := []struct {
+		name         string
+		allowSubdirs bool
+		valid        bool
+	}{
+		{"access.log", false, true},
+		{"web01", false, true},
+		{"app@host+1=a,b-c_d", false, true},
+		{"", false, false},
+		{".", false, false},
+		{"..", false, false},
+		{"..", true, false},
+		{"a/b", false, false},
+		{"a/b", true, true},
+		{"a/../b", true, false},
+		{"a/./b", true, false},
+		{"../a", true, false},
+		{"/etc/passwd", false, false},
+		{"/etc/passwd", true, false},
+		{"a//b", true, false},
+		{"a/", true, false},
+		{"a\x00b", false, false},
+		{"a\x00b", true, false},
+		{"a b", false, false},
+		{"a\\b", false, false},
+		{"file.log:stream", false, false},
+		{"C:", true, false},
+		{string(make([]byte, nameMaxLen+1)), false, false},
+	}
+	for _, tt := range tests {
+		if got := validName(tt.name, tt.allowSubdirs); got != tt.valid {
+			t.Errorf("validName(%q, %v) = %v, want %v", tt.name, tt.allowSubdirs, got, tt.valid)
+		}
+	}
+}
+
+func TestValidNameMaxLen(t *testing.T) {
+	name := make([]byte, nameMaxLen)
+	for i := range name {
+		name[i] = 'a'
+	}
+	if !validName(string(name), false) {
+		t.Errorf("validName rejects name of %d characters", nameMaxLen)
+	}
+	if validName(string(name)+"a", false) {
+		t.Errorf("validName accepts name of %d characters", nameMaxLen+1)
+	}
+}
+
+func TestParseDataArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want *DataArgs
+	}{
+		// headers of clients without versioning
+		{[]string{}, &DataArgs{Protocol: 1}},
+		{[]string{"17"}, &DataArgs{Protocol: 2, Bytes: 17}},
+		// versioned headers
+		{[]string{"v1"}, &DataArgs{Protocol: 1}},
+		{[]string{"17", "v2"}, &DataArgs{Protocol: 2, Bytes: 17}},
+		{[]string{"v2", "17"}, &DataArgs{Protocol: 2, Bytes: 17}},
+		{[]string{"17", "v2", "ack"}, &DataArgs{Protocol: 2, Bytes: 17, Ack: true}},
+		{[]string{"v1", "ack"}, &DataArgs{Protocol: 1, Ack: true}},
+		// unsupported combinations
+		{[]string{"v2"}, nil},
+		{[]string{"17", "v1"}, nil},
+		{[]string{"v3"}, nil},
+		{[]string{"17", "v3"}, nil},
+	}
+	for _, tt := range tests {
+		got, err := parseDataArgs(tt.args)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseDataArgs(%q) = %+v, want error", tt.args, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseDataArgs(%q) error: %s", tt.args, err)
+			continue
+		}
+		if *got != *tt.want {
+			t.Errorf("parseDataArgs(%q) = %+v, want %+v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestSplitFieldsLegacyHeaders(t *testing.T) {
+	tests := []string{
+		"DATA key app web01 access.log",
+		"DATA key app web01 access.log 128",
+		"ROTATE key app web01 access.log",
+		"ROTATE key app web01 access.log access.log.1",
+	}
+	for _, head := range tests {
+		args := strings.Fields(head)
+		rest, fields, err := splitFields(args, 5)
+		if err != nil {
+			t.Errorf("splitFields(%q) error: %s", head, err)
+			continue
+		}
+		if !reflect.DeepEqual(rest, strings.Fields(head)) || len(fields) != 0 {
+			t.Errorf("splitFields(%q) = %q, %v, want header unchanged", head, rest, fields)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	tests := []struct {
+		head    string
+		body    string
+		replies []string
+		stored  string
+	}{
+		// clients without versioning
+		{"DATA key app web01 access.log", "a\nb\n.\n", []string{"200 READY", "200 OK"}, "a\nb\n"},
+		{"DATA key app web01 access.log 4", "c\nd\n", []string{"200 READY protocol 2", "200 OK"}, "c\nd\n"},
+		// versioned clients
+		{"DATA key app web01 access.log v1", "a\n.\n", []string{"200 READY", "200 OK"}, "a\n"},
+		{"DATA key app web01 access.log 2 v2", "c\n", []string{"200 READY protocol 2", "200 OK"}, "c\n"},
+		{"DATA key app web01 access.log v1 ack", "a\nb\n.\n", []string{"200 READY", "200 OK 2"}, "a\nb\n"},
+		{"DATA key app web01 access.log v2", "", []string{"400 Unsupported protocol"}, ""},
+		{"DATA key app web01 access.log 4 v1", "", []string{"400 Unsupported protocol"}, ""},
+		{"DATA key app web01 access.log 4 v3", "", []string{"400 Unsupported protocol"}, ""},
+	}
+	for _, tt := range tests {
+		cfg := newTestConfig(t)
+		replies := request(t, cfg, newLocks(), tt.head, tt.body)
+		if !reflect.DeepEqual(replies, tt.replies) {
+			t.Errorf("%s: replies %q, want %q", tt.head, replies, tt.replies)
+			continue
+		}
+		if tt.stored != "" {
+			if got := readFile(t, cfg, "web01/access.log"); got != tt.stored {
+				t.Errorf("%s: stored %q, want %q", tt.head, got, tt.stored)
+			}
+		}
+	}
+}
+
+func TestHandshakeRotate(t *testing.T) {
+	cfg := newTestConfig(t)
+	locks := newLocks()
+	request(t, cfg, locks, "DATA key app web01 access.log", "a\n.\n")
+
+	replies := request(t, cfg, locks, "ROTATE key app web01 access.log access.log.1", "")
+	if !reflect.DeepEqual(replies, []string{"200 DONE"}) {
+		t.Fatalf("ROTATE replies %q, want 200 DONE", replies)
+	}
+	if got := readFile(t, cfg, "web01/access.log.1"); got != "a\n" {
+		t.Errorf("rotated file contains %q, want %q", got, "a\n")
+	}
+}
+
+// BenchmarkRequestWriter compares writer of request taken from writerPool
+// with the writer allocated for every request
+func BenchmarkRequestWriter(b *testing.B) {
+	size := 64 * 1024
+	data := []byte(strings.Repeat("x", 1023) + "\n")
+	writerPool.New = func() interface{} {
+		return bufio.NewWriterSize(nil, size)
+	}
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			w := writerPool.Get().(*bufio.Writer)
+			w.Reset(ioutil.Discard)
+			w.Write(data)
+			w.Flush()
+			w.Reset(nil)
+			writerPool.Put(w)
+		}
+	})
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			w := bufio.NewWriterSize(ioutil.Discard, size)
+			w.Write(data)
+			w.Flush()
+		}
+	})
+}
+
+func TestRotateKeepsCompressed(t *testing.T) {
+	cfg := newTestConfig(t)
+	locks := newLocks()
+	compressor = compress.NewPool(1, queue.NewQueue(1, queue.Block), compress.Perm{Mode: 0644, UID: -1, GID: -1}, nil)
+	defer func() {
+		compressor.Stop()
+		compressor = nil
+	}()
+
+	request(t, cfg, locks, "DATA key app web01 access.log", "a\n.\n")
+	if err := ioutil.WriteFile(filepath.Join(cfg.DestDir, "web01/access.log.1.gz"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	replies := request(t, cfg, locks, "ROTATE key app web01 access.log access.log.1", "")
+	if !reflect.DeepEqual(replies, []string{"400 Error"}) {
+		t.Errorf("ROTATE replies %q, want 400 Error", replies)
+	}
+	if got := readFile(t, cfg, "web01/access.log"); got != "a\n" {
+		t.Errorf("file contains %q after refused rotation, want %q", got, "a\n")
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.RotateMiss = "create"
+	locks := newLocks()
+	request(t, cfg, locks, "DATA key app web01 access.log", "a\n.\n")
+
+	tests := []string{
+		"ROTATE wrong app web01 access.log access.log.1",
+		"ROTATE wrong app web01 other.log other.log.1",
+		"DATA wrong app web01 new.log",
+	}
+	for _, head := range tests {
+		if replies := request(t, cfg, locks, head, "b\n.\n"); len(replies) != 0 {
+			t.Errorf("%s: replies %q, want none", head, replies)
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(cfg.DestDir, "web01", "*"))
+	if len(files) != 1 || filepath.Base(files[0]) != "access.log" {
+		t.Errorf("files after requests with wrong key: %q, want only access.log", files)
+	}
+}
+
+func TestRotateFields(t *testing.T) {
+	tests := []struct {
+		head    string
+		replies []string
+		rotated string
+	}{
+		{"ROTATE key app web01 access.log env=prod", []string{"200 DONE"}, "web01/access.log-*"},
+		{"ROTATE key app web01 access.log access.log.1 env=prod", []string{"200 DONE"}, "web01/access.log.1"},
+		{"ROTATE key app web01 access.log env=prod access.log.1", []string{"200 DONE"}, "web01/access.log.1"},
+		{"ROTATE key app web01 access.log access.log=1", []string{"400 Malformed header"}, ""},
+	}
+	for _, tt := range tests {
+		cfg := newTestConfig(t)
+		locks := newLocks()
+		request(t, cfg, locks, "DATA key app web01 access.log", "a\n.\n")
+		if replies := request(t, cfg, locks, tt.head, ""); !reflect.DeepEqual(replies, tt.replies) {
+			t.Errorf("%s: replies %q, want %q", tt.head, replies, tt.replies)
+			continue
+		}
+		if tt.rotated == "" {
+			continue
+		}
+		files, _ := filepath.Glob(filepath.Join(cfg.DestDir, tt.rotated))
+		if len(files) != 1 {
+			t.Errorf("%s: rotated files %q, want one %s", tt.head, files, tt.rotated)
+		}
+	}
+}
+
+func TestRotateFieldTemplate(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.PathTpl = "{field.env}/{dir}/{name}"
+	locks := newLocks()
+	request(t, cfg, locks, "DATA key app web01 access.log env=prod", "a\n.\n")
+
+	// rotate_name names the file, ROTATE only repeats the fields
+	if replies := request(t, cfg, locks, "ROTATE key app web01 access.log env=prod", ""); !reflect.DeepEqual(replies, []string{"200 DONE"}) {
+		t.Fatalf("ROTATE replies %q, want 200 DONE", replies)
+	}
+	files, _ := filepath.Glob(filepath.Join(cfg.DestDir, "prod/web01/access.log-*"))
+	if len(files) != 1 {
+		t.Errorf("rotated files %q, want one named by rotate_name", files)
+	}
+}
+
+func TestCheckPathTemplate(t *testing.T) {
+	tests := []struct {
+		tpl   string
+		valid bool
+	}{
+		{"{dir}/{name}", true},
+		{"{group}/{yyyy}/{mm}/{dd}/{hh}/{dir}/{name}", true},
+		{"{field.env}/{dir}/{name}", true},
+		{"{dir}/{yyyy}-{mm}/{name}", true},
+		{"{dir}", false},
+		{"{dir}/{Group}/{name}", false},
+		{"{dir}/{yyyy-mm}/{name}", false},
+		{"{dir}/{}/{name}", false},
+		{"{dir}/{field}/{name}", false},
+		{"{dir}/{name.x}/{name}", false},
+		{"{dir}/{field.a b}/{name}", false},
+		{"../{name}", false},
+		{"{dir}/../../{name}", false},
+		{"/{name}", true},
+	}
+	for _, tt := range tests {
+		err := checkPathTemplate(tt.tpl, "/var/log/remote")
+		if (err == nil) != tt.valid {
+			t.Errorf("checkPathTemplate(%q) = %v, want valid %v", tt.tpl, err, tt.valid)
+		}
+	}
+}
+
+func TestCheckTransformOrder(t *testing.T) {
+	tests := []struct {
+		order []string
+		valid bool
+	}{
+		{[]string{"filter", "sample"}, true},
+		{[]string{"sample", "filter"}, true},
+		{[]string{"filter"}, false},
+		{[]string{}, false},
+		{[]string{"filter", "sample", "filter"}, false},
+		{[]string{"filter", "sample", "dedup"}, false},
+	}
+	for _, tt := range tests {
+		if err := checkTransformOrder(tt.order); (err == nil) != tt.valid {
+			t.Errorf("checkTransformOrder(%q) = %v, want valid %v", tt.order, err, tt.valid)
+		}
+	}
+}
+
+func TestThrottleBlock(t *testing.T) {
+	limit := ratelimit.NewBucket(10000, 10000)
+	started := time.Now()
+	throttle(limit, "block", 15000, make(chan bool))
+	if elapsed := time.Since(started); elapsed < 400*time.Millisecond {
+		t.Errorf("request over the rate slept %s, want about 500ms", elapsed)
+	}
+
+	stopping := make(chan bool)
+	close(stopping)
+	started = time.Now()
+	throttle(limit, "block", 15000, stopping)
+	if elapsed := time.Since(started); elapsed > 100*time.Millisecond {
+		t.Errorf("throttle slept %s on shutdown", elapsed)
+	}
+}
+
+func TestThrottleDrop(t *testing.T) {
+	limit := ratelimit.NewBucket(1000, 1000)
+	if !throttle(limit, "drop", 600, nil) {
+		t.Errorf("bytes within the limit dropped")
+	}
+	if throttle(limit, "drop", 600, nil) {
+		t.Errorf("bytes over the limit kept")
+	}
+	if !throttle(limit, "drop", 300, nil) {
+		t.Errorf("bytes within the rest of the limit dropped")
+	}
+}
+
+func TestLineLimiter(t *testing.T) {
+	l := &lineLimiter{limit: ratelimit.NewBucket(1000, 1000)}
+	// line started within the limit is kept whole across chunks
+	if got := string(l.Keep([]byte("a\n" + strings.Repeat("x", 990)))); got != "a\n"+strings.Repeat("x", 990) {
+		t.Errorf("first chunk kept %q", got)
+	}
+	if got := string(l.Keep([]byte("xxxxxxxxxx\nb\n"))); got != "xxxxxxxxxx\n" {
+		t.Errorf("second chunk kept %q, want end of the started line", got)
+	}
+	if l.dropped != 2 {
+		t.Errorf("%d bytes dropped, want 2", l.dropped)
+	}
+}
+
+func TestRateLimitDrop(t *testing.T) {
+	line := strings.Repeat("x", 99) + "\n"
+	body := strings.Repeat(line, 30)
+	tests := []struct {
+		head    string
+		body    string
+		replies []string
+	}{
+		{"DATA key app web01 access.log v1 ack", body + ".\n", []string{"200 READY", "200 OK 10"}},
+		{"DATA key app web01 access.log 3000 v2", body, []string{"200 READY protocol 2", "200 OK"}},
+	}
+	for _, tt := range tests {
+		cfg := newTestConfig(t)
+		cfg.RateLimit = 1000
+		cfg.RateMode = "drop"
+		replies := request(t, cfg, newLocks(), tt.head, tt.body)
+		if !reflect.DeepEqual(replies, tt.replies) {
+			t.Errorf("%s: replies %q, want %q", tt.head, replies, tt.replies)
+			continue
+		}
+		if got := readFile(t, cfg, "web01/access.log"); got != strings.Repeat(line, 10) {
+			t.Errorf("%s: stored %d bytes, want 10 lines within the limit", tt.head, len(got))
+		}
+	}
+}
+
+// failingListener fails every Accept, like a listener out of file descriptors
+type failingListener struct {
+	net.Listener
+	accepts int32
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	atomic.AddInt32(&l.accepts, 1)
+	return nil, syscall.EMFILE
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	l := &failingListener{}
+	stopping := make(chan bool)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go acceptLoop(context.Background(), l, newTestConfig(t), newLocks(), stopping, wg)
+	time.Sleep(200 * time.Millisecond)
+	close(stopping)
+	wg.Wait()
+	// pauses of 5, 10, 20, 40 and 80ms fit in 200ms
+	if n := atomic.LoadInt32(&l.accepts); n > 10 {
+		t.Errorf("%d accepts in 200ms, want backoff between failures", n)
+	}
+}
+
+func TestEmptyLines(t *testing.T) {
+	tests := []struct {
+		body    string
+		replies []string
+		stored  string
+	}{
+		{"\n.\n", []string{"200 READY", "200 OK 1"}, "\n"},
+		{"\n\n.\n", []string{"200 READY", "200 OK 2"}, "\n\n"},
+		{"a\n\nb\n.\n", []string{"200 READY", "200 OK 3"}, "a\n\nb\n"},
+	}
+	for _, tt := range tests {
+		cfg := newTestConfig(t)
+		replies := request(t, cfg, newLocks(), "DATA key app web01 access.log v1 ack", tt.body)
+		if !reflect.DeepEqual(replies, tt.replies) {
+			t.Errorf("%q: replies %q, want %q", tt.body, replies, tt.replies)
+			continue
+		}
+		if got := readFile(t, cfg, "web01/access.log"); got != tt.stored {
+			t.Errorf("%q: stored %q, want %q", tt.body, got, tt.stored)
+		}
+	}
+}
+
+func TestSourceName(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"2001:db8::1", "2001_db8__1"},
+		{"fe80::1%eth0", "fe80__1"},
+		{"local", "local"},
+	}
+	for _, tt := range tests {
+		got := sourceName(tt.addr)
+		if got != tt.want {
+			t.Errorf("sourceName(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+		if !validName(got, false) {
+			t.Errorf("sourceName(%q) = %q is not a valid name", tt.addr, got)
+		}
+	}
+}
+
+func TestDedupRequest(t *testing.T) {
+	tests := []struct {
+		stamp  bool
+		body   string
+		stored string
+	}{
+		// summary of repeats before the terminator belongs to the request
+		{false, "a\na\na\n.\n", "a\n(repeated 2 times)\n"},
+		{false, "a\na\nb\n.\n", "a\n(repeated 1 times)\nb\n"},
+		// lines are compared before they are stamped
+		{true, "a\na\n.\n", "T a\nT (repeated 1 times)\n"},
+	}
+	for _, tt := range tests {
+		cfg := newTestConfig(t)
+		dedupConfigs = []DedupConfig{{Match: "web01/*", Window: 60, MaxLine: 100}}
+		stampConfigs = nil
+		if tt.stamp {
+			stampConfigs = []StampConfig{{Match: "web01/*", Format: "T"}}
+		}
+		request(t, cfg, newLocks(), "DATA key app web01 access.log", tt.body)
+		if got := readFile(t, cfg, "web01/access.log"); got != tt.stored {
+			t.Errorf("%q: stored %q, want %q", tt.body, got, tt.stored)
+		}
+	}
+	dedupConfigs, stampConfigs = nil, nil
+}
+
+func TestSampleAcrossRequests(t *testing.T) {
+	cfg := newTestConfig(t)
+	sampleConfigs = []SampleConfig{{Match: "web01/*", Rate: 2, Mode: "every"}}
+	defer func() { sampleConfigs = nil }()
+	locks := newLocks()
+
+	// sampler of the file keeps counting in the second request
+	request(t, cfg, locks, "DATA key app web01 access.log", "a\nb\nc\n.\n")
+	request(t, cfg, locks, "DATA key app web01 access.log", "d\ne\n.\n")
+	if got := readFile(t, cfg, "web01/access.log"); got != "a\nc\ne\n" {
+		t.Errorf("stored %q, want %q", got, "a\nc\ne\n")
+	}
+}
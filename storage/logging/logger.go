@@ -153,7 +153,7 @@ func (l *FileLogger) Reopen() error {
 	var loggerOut io.Writer
 
 	if l.fd != nil {
-		loggerOut = l.fd
+		loggerOut = &fallbackWriter{fd: l.fd}
 	} else {
 		loggerOut = os.Stderr
 	}
@@ -166,6 +166,25 @@ func (l *FileLogger) Reopen() error {
 	return nil
 }
 
+// fallbackWriter пишет в stderr то, что не удалось записать в файл лога
+// (например, кончилось место), чтобы логирование не останавливало работу
+type fallbackWriter struct {
+	fd     *os.File
+	failed bool
+}
+
+func (w *fallbackWriter) Write(p []byte) (int, error) {
+	if _, err := w.fd.Write(p); err != nil {
+		if !w.failed {
+			w.failed = true
+			fmt.Fprintf(os.Stderr, "Can't write log %s, writing to stderr: %s\n", w.fd.Name(), err)
+		}
+		return os.Stderr.Write(p)
+	}
+	w.failed = false
+	return len(p), nil
+}
+
 // Filename возвращает текущее имя файла
 func (l *FileLogger) Filename() string {
 	l.RLock()
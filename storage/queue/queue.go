@@ -0,0 +1,136 @@
+package queue
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Policy поведение Queue.Push при заполненной очереди
+type Policy string
+
+const (
+	// Block ждать освобождения места
+	Block Policy = "block"
+	// DropOldest выкинуть самый старый элемент очереди
+	DropOldest Policy = "drop-oldest"
+	// RejectNew выкинуть добавляемый элемент
+	RejectNew Policy = "reject-new"
+)
+
+// ParsePolicy проверяет название политики
+func ParsePolicy(name string) (Policy, error) {
+	switch policy := Policy(name); policy {
+	case Block, DropOldest, RejectNew:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown queue policy %#v", name)
+}
+
+// Job файл в очереди и сведения о потоке, из которого он получен
+type Job struct {
+	Path  string // путь к файлу
+	Group string // группа из заголовка запроса
+	Key   string // dir/name файла из заголовка запроса
+}
+
+// Queue ограниченная очередь файлов с политикой переполнения
+type Queue struct {
+	sync.RWMutex
+	items   chan Job
+	policy  Policy
+	dropped int64
+	closed  bool
+	onDrop  func(Job)
+}
+
+// NewQueue создает инстанс Queue размера size
+func NewQueue(size int, policy Policy) *Queue {
+	return &Queue{
+		items:  make(chan Job, size),
+		policy: policy,
+	}
+}
+
+// OnDrop задает функцию, которая вызывается для каждого выкинутого элемента:
+// отвергнутого RejectNew или после Close и вытесненного DropOldest.
+// Вызывается из Push вне блокировок очереди. Задается до первого Push
+func (q *Queue) OnDrop(f func(Job)) {
+	q.onDrop = f
+}
+
+// Push добавляет элемент в очередь. Возвращает false, если элемент был выкинут.
+// После Close элементы не принимаются
+func (q *Queue) Push(item Job) bool {
+	ok, dropped := q.push(item)
+	atomic.AddInt64(&q.dropped, int64(len(dropped)))
+	if q.onDrop != nil {
+		for _, job := range dropped {
+			q.onDrop(job)
+		}
+	}
+	return ok
+}
+
+// push добавляет элемент в очередь, возвращает выкинутые элементы
+func (q *Queue) push(item Job) (bool, []Job) {
+	// Close ждет Push, заблокированные на полной очереди, поэтому канал
+	// не закрывается под ними
+	q.RLock()
+	defer q.RUnlock()
+	if q.closed {
+		return false, []Job{item}
+	}
+	switch q.policy {
+	case DropOldest:
+		dropped := []Job{}
+		for {
+			select {
+			case q.items <- item:
+				return true, dropped
+			default:
+			}
+			select {
+			case old := <-q.items:
+				dropped = append(dropped, old)
+			default:
+			}
+		}
+	case RejectNew:
+		select {
+		case q.items <- item:
+			return true, nil
+		default:
+			return false, []Job{item}
+		}
+	}
+	q.items <- item
+	return true, nil
+}
+
+// Items канал для чтения элементов, закрывается по Close
+func (q *Queue) Items() <-chan Job {
+	return q.items
+}
+
+// Close закрывает очередь, Push после этого отказывает.
+// Дожидается уже начатых Push, так что читатели Items должны продолжать чтение.
+// Повторные вызовы ничего не делают
+func (q *Queue) Close() {
+	q.Lock()
+	defer q.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.items)
+	}
+}
+
+// Len возвращает количество элементов в очереди
+func (q *Queue) Len() int {
+	return len(q.items)
+}
+
+// Dropped возвращает количество выкинутых элементов
+func (q *Queue) Dropped() int64 {
+	return atomic.LoadInt64(&q.dropped)
+}
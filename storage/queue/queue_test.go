@@ -0,0 +1,43 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCloseWaitsBlockedPush(t *testing.T) {
+	q := NewQueue(1, Block)
+	q.Push(Job{Path: "a"})
+	pushed := make(chan bool)
+	go func() {
+		pushed <- q.Push(Job{Path: "b"})
+	}()
+	// let the second Push block on the full queue
+	time.Sleep(50 * time.Millisecond)
+	go q.Close()
+
+	paths := []string{}
+	for job := range q.Items() {
+		paths = append(paths, job.Path)
+	}
+	if !<-pushed {
+		t.Errorf("blocked Push was rejected by Close")
+	}
+	if len(paths) != 2 || paths[0] != "a" || paths[1] != "b" {
+		t.Errorf("read %q, want [a b]", paths)
+	}
+}
+
+func TestPushAfterClose(t *testing.T) {
+	for _, policy := range []Policy{Block, DropOldest, RejectNew} {
+		q := NewQueue(1, policy)
+		q.Close()
+		q.Close()
+		if q.Push(Job{Path: "a"}) {
+			t.Errorf("%s: Push after Close accepted", policy)
+		}
+		if q.Dropped() != 1 {
+			t.Errorf("%s: %d dropped, want 1", policy, q.Dropped())
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket token bucket: rate токенов в секунду, не более burst накопленных
+type Bucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket создает инстанс Bucket с полным запасом токенов
+func NewBucket(rate, burst int) *Bucket {
+	if burst < rate {
+		burst = rate
+	}
+	return &Bucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *Bucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Take забирает n токенов в долг и возвращает время, которое нужно подождать до их появления
+func (b *Bucket) Take(n int) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// TryTake забирает n токенов, если они есть. Возвращает false, если токенов не хватает.
+// n больше burst уменьшается до burst, иначе такой запрос не прошел бы никогда
+func (b *Bucket) TryTake(n int) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill()
+	cost := float64(n)
+	if cost > b.burst {
+		cost = b.burst
+	}
+	if b.tokens < cost {
+		return false
+	}
+	b.tokens -= cost
+	return true
+}
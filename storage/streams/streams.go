@@ -0,0 +1,144 @@
+package streams
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stream состояние записи одного DATA запроса
+type Stream struct {
+	name    string
+	remote  string
+	started time.Time
+	lines   int64
+	bytes   int64
+	bufPeak int64
+	flushed int64
+}
+
+// AddLines учитывает записанные строки
+func (s *Stream) AddLines(n int) {
+	atomic.AddInt64(&s.lines, int64(n))
+}
+
+// AddBytes учитывает записанные байты
+func (s *Stream) AddBytes(n int) {
+	atomic.AddInt64(&s.bytes, int64(n))
+}
+
+// NoteBuffered учитывает заполнение буфера записи, хранится максимум
+func (s *Stream) NoteBuffered(n int) {
+	for {
+		peak := atomic.LoadInt64(&s.bufPeak)
+		if int64(n) <= peak || atomic.CompareAndSwapInt64(&s.bufPeak, peak, int64(n)) {
+			return
+		}
+	}
+}
+
+// NoteFlush отмечает время записи буфера в файл
+func (s *Stream) NoteFlush() {
+	atomic.StoreInt64(&s.flushed, time.Now().UnixNano())
+}
+
+// Writer возвращает обертку над w, которая вызывает NoteFlush на каждую запись
+func (s *Stream) Writer(w io.Writer) io.Writer {
+	return &flushWriter{w: w, stream: s}
+}
+
+type flushWriter struct {
+	w      io.Writer
+	stream *Stream
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if n > 0 {
+		fw.stream.NoteFlush()
+	}
+	return n, err
+}
+
+// Info снимок состояния Stream для отдачи наружу
+type Info struct {
+	Name    string     `json:"name"`
+	Remote  string     `json:"remote"`
+	Started time.Time  `json:"started"`
+	Lines   int64      `json:"lines_received"`
+	Bytes   int64      `json:"bytes_received"`
+	BufPeak int64      `json:"buffer_peak"`
+	Flushed *time.Time `json:"last_flush"`
+}
+
+// Registry список выполняющихся DATA запросов
+type Registry struct {
+	sync.Mutex
+	items map[*Stream]bool
+}
+
+// NewRegistry создает инстанс Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		items: make(map[*Stream]bool),
+	}
+}
+
+// Open регистрирует запись в файл name от клиента remote
+func (r *Registry) Open(name string, remote string) *Stream {
+	s := &Stream{
+		name:    name,
+		remote:  remote,
+		started: time.Now(),
+	}
+	r.Lock()
+	r.items[s] = true
+	r.Unlock()
+	return s
+}
+
+// Close снимает запись с регистрации
+func (r *Registry) Close(s *Stream) {
+	r.Lock()
+	delete(r.items, s)
+	r.Unlock()
+}
+
+// Snapshot возвращает состояние всех записей, отсортированное по имени файла
+func (r *Registry) Snapshot() []Info {
+	r.Lock()
+	items := make([]*Stream, 0, len(r.items))
+	for s := range r.items {
+		items = append(items, s)
+	}
+	r.Unlock()
+
+	infos := make([]Info, len(items))
+	for i, s := range items {
+		infos[i] = Info{
+			Name:    s.name,
+			Remote:  s.remote,
+			Started: s.started,
+			Lines:   atomic.LoadInt64(&s.lines),
+			Bytes:   atomic.LoadInt64(&s.bytes),
+			BufPeak: atomic.LoadInt64(&s.bufPeak),
+		}
+		// null пока буфер еще ни разу не записывался в файл
+		if flushed := atomic.LoadInt64(&s.flushed); flushed > 0 {
+			t := time.Unix(0, flushed)
+			infos[i].Flushed = &t
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// ServeHTTP отдает Snapshot в JSON
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.Snapshot())
+}
@@ -0,0 +1,48 @@
+package streams
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotFlush(t *testing.T) {
+	r := NewRegistry()
+	s := r.Open("web01/access.log", "127.0.0.1")
+	s.AddLines(2)
+	s.AddBytes(4)
+
+	w := bufio.NewWriterSize(s.Writer(ioutil.Discard), 16)
+	w.Write([]byte("a\nb\n"))
+	if info := r.Snapshot()[0]; info.Flushed != nil {
+		t.Errorf("last_flush is set before flush: %v", info.Flushed)
+	}
+	w.Flush()
+	info := r.Snapshot()[0]
+	if info.Flushed == nil {
+		t.Fatalf("last_flush is not set after flush")
+	}
+	if info.Lines != 2 || info.Bytes != 4 {
+		t.Errorf("received %d lines %d bytes, want 2 lines 4 bytes", info.Lines, info.Bytes)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.Open("web01/access.log", "127.0.0.1")
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/streams", nil))
+	var infos []map[string]interface{}
+	if err := json.NewDecoder(strings.NewReader(rec.Body.String())).Decode(&infos); err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+	for _, key := range []string{"lines_received", "bytes_received", "buffer_peak", "last_flush"} {
+		if _, ok := infos[0][key]; !ok {
+			t.Errorf("field %s missing in %s", key, rec.Body.String())
+		}
+	}
+}